@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"kubevirt-device-plugin/pkg/device_plugin"
+)
+
+// runDoctor handles the doctor command and returns the exit code: 0 if the
+// host is ready, 1 if a check failed, or with --strict a check warned, and 2
+// if the checks could not run, e.g. on bad arguments or an invalid config.
+func runDoctor(args []string) int {
+	var output string
+	var strict bool
+
+	flags, configPath := newFlagSet("doctor")
+	flags.StringVar(&output, "output", device_plugin.OutputTable, "output format, table or json")
+	flags.StringVar(&output, "o", device_plugin.OutputTable, "shorthand for --output")
+	flags.BoolVar(&strict, "strict", false, "exit with 1 on warnings as well")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	log.SetOutput(io.Discard)
+
+	worst, err := device_plugin.RunDoctor(os.Stdout, output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if worst == device_plugin.DoctorFail || (strict && worst == device_plugin.DoctorWarn) {
+		return 1
+	}
+	return 0
+}
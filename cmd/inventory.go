@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"kubevirt-device-plugin/pkg/device_plugin"
+)
+
+// runList handles the list command and returns the exit code.
+func runList(args []string) int {
+	var output string
+
+	flags, configPath := newFlagSet("list")
+	flags.StringVar(&output, "output", device_plugin.OutputTable, "output format, table or json")
+	flags.StringVar(&output, "o", device_plugin.OutputTable, "shorthand for --output")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// discovery logs every device it looks at
+	log.SetOutput(io.Discard)
+
+	if err := device_plugin.PrintInventory(os.Stdout, output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runInspect handles the inspect command and returns the exit code.
+func runInspect(args []string) int {
+	var output string
+
+	flags, configPath := newFlagSet("inspect")
+	flags.StringVar(&output, "output", device_plugin.OutputYAML, "output format, yaml or json")
+	flags.StringVar(&output, "o", device_plugin.OutputYAML, "shorthand for --output")
+	positional, err := parseFlags(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		flags.Usage()
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	log.SetOutput(io.Discard)
+
+	if err := device_plugin.PrintInspect(os.Stdout, positional[0], output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"kubevirt-device-plugin/pkg/device_plugin"
+)
+
+// runPermittedDevices handles the permitted-devices command and returns the
+// exit code: 1 if the devices cannot be listed or the KubeVirt CR does not
+// match them.
+func runPermittedDevices(args []string) int {
+	var validate string
+
+	flags, configPath := newFlagSet("permitted-devices")
+	flags.StringVar(&validate, "validate", "", "KubeVirt CR to check against the devices on this node")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// discovery logs every device it looks at
+	log.SetOutput(io.Discard)
+
+	if validate == "" {
+		if err := device_plugin.PrintPermittedHostDevices(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	ok, err := device_plugin.ValidatePermittedHostDevices(validate, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !ok {
+		return 1
+	}
+	fmt.Printf("%s matches the devices on this node\n", validate)
+	return 0
+}
@@ -1,7 +1,154 @@
 package main
 
-import "kubevirt-device-plugin/pkg/device_plugin"
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"kubevirt-device-plugin/pkg/device_plugin"
+)
+
+const usage = `Usage: xdxct-kubevirt-device-plugin [COMMAND] [--config <file>] [ARG...]
+
+Without a command the device plugin daemon is started.
+
+Commands:
+    bind [-a | --all] [-d | --device-id <pci-addr>] [--include-group]
+                                                       bind selected devices to their passthrough driver
+    unbind [-a | --all] [-d | --device-id <pci-addr>]  release selected devices from their passthrough driver
+    status                                             show the driver of every selected device
+    list [-o | --output table|json]                    show every selected GPU and its vGPUs
+    inspect [-o | --output yaml|json] <pci-addr|uuid|iommu-group>
+                                                       show everything known about a device
+    permitted-devices [--validate <kubevirt-cr.yaml>]  print the KubeVirt permittedHostDevices for this
+                                                       node, or check a KubeVirt CR against them
+    doctor [-o | --output table|json] [--strict]       check the host prerequisites, exit with 1 if
+                                                       one fails, 2 if they could not be checked
+    help                                               show this help
+
+The configuration file defaults to $XDXCT_DEVICE_PLUGIN_CONFIG.
+`
 
 func main() {
-	device_plugin.InitiateDevicePlugin()
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "":
+		os.Exit(runDaemon(args))
+	case "bind", "unbind":
+		os.Exit(runVfioCommand(command, args))
+	case "status":
+		os.Exit(runStatus(args))
+	case "list":
+		os.Exit(runList(args))
+	case "inspect":
+		os.Exit(runInspect(args))
+	case "permitted-devices":
+		os.Exit(runPermittedDevices(args))
+	case "doctor":
+		os.Exit(runDoctor(args))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	configPath := flags.String("config", os.Getenv(device_plugin.ConfigEnv), "path to the YAML or JSON configuration file")
+	return flags, configPath
+}
+
+// parseFlags parses args like flags.Parse, but goes on after a positional
+// argument, so flags may come before or after it: `inspect <addr> -o json`
+// works like `inspect -o json <addr>`. Everything after "--" is positional.
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := flags.Args()
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// loadConfig reads, validates and applies the configuration file, so invalid
+// settings are reported before anything touches a device.
+func loadConfig(path string) error {
+	cfg, err := device_plugin.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	device_plugin.SetConfig(cfg)
+	return nil
+}
+
+func runDaemon(args []string) int {
+	flags, configPath := newFlagSet("xdxct-kubevirt-device-plugin")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		device_plugin.Shutdown()
+		sig = <-signals
+		log.Printf("Received %s again, exiting without cleanup", sig)
+		os.Exit(1)
+	}()
+
+	if err := device_plugin.InitiateDevicePlugin(*configPath); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func runStatus(args []string) int {
+	flags, configPath := newFlagSet("status")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := device_plugin.PrintVfioStatus(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
 }
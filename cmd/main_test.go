@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"kubevirt-device-plugin/pkg/device_plugin"
+)
+
+func TestParseFlags(t *testing.T) {
+	for _, tt := range []struct {
+		args           []string
+		wantPositional []string
+		wantOutput     string
+	}{
+		{[]string{"-o", "json", "0000:3b:00.0"}, []string{"0000:3b:00.0"}, device_plugin.OutputJSON},
+		{[]string{"0000:3b:00.0", "-o", "json"}, []string{"0000:3b:00.0"}, device_plugin.OutputJSON},
+		{[]string{"0000:3b:00.0", "--output=json", "7"}, []string{"0000:3b:00.0", "7"}, device_plugin.OutputJSON},
+		{[]string{"0000:3b:00.0"}, []string{"0000:3b:00.0"}, device_plugin.OutputYAML},
+		{[]string{"--", "-o", "json"}, []string{"-o", "json"}, device_plugin.OutputYAML},
+	} {
+		var output string
+		flags, _ := newFlagSet("inspect")
+		flags.StringVar(&output, "o", device_plugin.OutputYAML, "")
+		flags.StringVar(&output, "output", device_plugin.OutputYAML, "")
+
+		positional, err := parseFlags(flags, tt.args)
+		if err != nil {
+			t.Errorf("parseFlags(%q): %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(positional, tt.wantPositional) || output != tt.wantOutput {
+			t.Errorf("parseFlags(%q) = %q with output %s, want %q with %s", tt.args, positional, output, tt.wantPositional, tt.wantOutput)
+		}
+	}
+
+	flags, _ := newFlagSet("inspect")
+	flags.SetOutput(io.Discard)
+	if _, err := parseFlags(flags, []string{"0000:3b:00.0", "-x"}); err == nil {
+		t.Error("unknown flag after the positional argument accepted")
+	}
+}
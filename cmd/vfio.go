@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"kubevirt-device-plugin/pkg/device_plugin"
+)
+
+// runVfioCommand handles the bind and unbind commands and returns the exit code.
+func runVfioCommand(command string, args []string) int {
+	var all, includeGroup bool
+	var deviceID string
+
+	flags, configPath := newFlagSet(command)
+	flags.BoolVar(&all, "all", false, "act on every Xdxct GPU")
+	flags.BoolVar(&all, "a", false, "shorthand for --all")
+	flags.StringVar(&deviceID, "device-id", "", "PCI address of the GPU to act on")
+	flags.StringVar(&deviceID, "d", "", "shorthand for --device-id")
+	if command == "bind" {
+		flags.BoolVar(&includeGroup, "include-group", false, "also bind the functions sharing an IOMMU group with a selected device that no selector matches")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 || all == (deviceID != "") {
+		flags.Usage()
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var err error
+	if command == "bind" {
+		err = device_plugin.BindVfioDevices(deviceID, includeGroup)
+	} else {
+		err = device_plugin.UnbindVfioDevices(deviceID)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", command, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,204 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+// CDI spec version written by the plugin, the oldest one with everything used
+// here so that older runtimes can read the specs as well.
+const cdiVersion = "0.5.0"
+
+// CDI device classes, the specs are written to <namespace>-<class>.yaml.
+// Passthrough devices get a spec per namespace they are advertised under.
+const (
+	cdiClassGpu  = "gpu"
+	cdiClassVgpu = "vgpu"
+)
+
+// cdiSpecPath is the directory the CDI specs are written to
+var cdiSpecPath = "/var/run/cdi"
+
+// cdiSpec is the subset of the Container Device Interface spec the plugin
+// writes, see https://github.com/cncf-tags/container-device-interface.
+type cdiSpec struct {
+	Version        string            `json:"cdiVersion"`
+	Kind           string            `json:"kind"`
+	Devices        []cdiDevice       `json:"devices"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits,omitempty"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	Env         []string        `json:"env,omitempty"`
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes,omitempty"`
+}
+
+type cdiDeviceNode struct {
+	Path        string `json:"path"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+func cdiKind(namespace string, class string) string {
+	return fmt.Sprintf("%s/%s", namespace, class)
+}
+
+// cdiDevices returns the fully qualified CDI names of the devices, e.g.
+// xdxct.com/gpu=7, for the Allocate response.
+func cdiDevices(kind string, ids []string) []*pluginapi.CDIDevice {
+	devs := make([]*pluginapi.CDIDevice, 0, len(ids))
+	for _, id := range ids {
+		devs = append(devs, &pluginapi.CDIDevice{Name: fmt.Sprintf("%s=%s", kind, id)})
+	}
+	return devs
+}
+
+// cdiEnvName returns the variable a CDI device describes itself with. It is
+// the KubeVirt variable of the resource suffixed with the device, as the
+// KubeVirt variable itself lists every device allocated to the container.
+func cdiEnvName(prefix string, resourceName string, id string) string {
+	suffix := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_", ":", "_").Replace(id))
+	return fmt.Sprintf("%s_%s", resourceEnvName(prefix, resourceName), suffix)
+}
+
+func vfioDeviceNode(group string) cdiDeviceNode {
+	return cdiDeviceNode{Path: filepath.Join(vfioDevicePath, group), Permissions: "rw"}
+}
+
+// buildPciCdiSpecs describes every advertised IOMMU group with its VFIO group
+// node and PCI functions, in a spec per namespace. Every namespace passed in
+// gets a spec, even if none of its devices are present.
+func buildPciCdiSpecs(devices map[string][]string, resourceNamespaces map[string]string, iommus map[string][]XdxctGpuDevice, namespaces []string) map[string]*cdiSpec {
+	specs := make(map[string]*cdiSpec)
+	for _, namespace := range namespaces {
+		specs[namespace] = newCdiSpec(namespace, cdiClassGpu)
+	}
+	for deviceName, groups := range pciResources(devices) {
+		namespace := resourceNamespaces[deviceName]
+		spec, ok := specs[namespace]
+		if !ok {
+			spec = newCdiSpec(namespace, cdiClassGpu)
+			specs[namespace] = spec
+		}
+		for _, group := range groups {
+			var addrs []string
+			for _, dev := range iommus[group] {
+				addrs = append(addrs, dev.addr)
+			}
+			spec.Devices = append(spec.Devices, cdiDevice{
+				Name: group,
+				ContainerEdits: cdiContainerEdits{
+					Env:         []string{fmt.Sprintf("%s=%s", cdiEnvName(gpuPrefix, namespace+"/"+deviceName, group), strings.Join(addrs, ","))},
+					DeviceNodes: []cdiDeviceNode{vfioDeviceNode(group)},
+				},
+			})
+		}
+	}
+	for _, spec := range specs {
+		sortCdiDevices(spec)
+	}
+	return specs
+}
+
+// buildVgpuCdiSpec describes every advertised mdev with the VFIO group node
+// vfio-mdev created for it. mdevs without an IOMMU group are left out.
+func buildVgpuCdiSpec(vgpus map[string][]XdxctGpuDevice) *cdiSpec {
+	spec := newCdiSpec(DeviceNamespace, cdiClassVgpu)
+	for deviceName, devs := range vgpuResources(vgpus) {
+		for _, dev := range devs {
+			group, err := readLink(vGpuBasePath, dev.addr, "iommu_group")
+			if err != nil {
+				log.Printf("Leaving vGPU %s out of the CDI spec, no IOMMU group: %v", dev.addr, err)
+				continue
+			}
+			spec.Devices = append(spec.Devices, cdiDevice{
+				Name: dev.addr,
+				ContainerEdits: cdiContainerEdits{
+					Env:         []string{fmt.Sprintf("%s=%s", cdiEnvName(vgpuPrefix, DeviceNamespace+"/"+deviceName, dev.addr), dev.addr)},
+					DeviceNodes: []cdiDeviceNode{vfioDeviceNode(group)},
+				},
+			})
+		}
+	}
+	sortCdiDevices(spec)
+	return spec
+}
+
+func newCdiSpec(namespace string, class string) *cdiSpec {
+	return &cdiSpec{
+		Version: cdiVersion,
+		Kind:    cdiKind(namespace, class),
+		Devices: []cdiDevice{},
+		ContainerEdits: cdiContainerEdits{
+			DeviceNodes: []cdiDeviceNode{vfioDeviceNode("vfio")},
+		},
+	}
+}
+
+func sortCdiDevices(spec *cdiSpec) {
+	sort.Slice(spec.Devices, func(i, j int) bool { return spec.Devices[i].Name < spec.Devices[j].Name })
+}
+
+// writeCdiSpec replaces the spec file of the kind. The file is renamed into
+// place, so runtimes never read a partial spec.
+func writeCdiSpec(spec *cdiSpec) error {
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cdiSpecPath, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(cdiSpecPath, strings.Replace(spec.Kind, "/", "-", 1)+".yaml")
+	tmp, err := os.CreateTemp(cdiSpecPath, ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// updatePciCdiSpec writes the CDI specs of the passthrough devices currently in
+// the device maps.
+func updatePciCdiSpec() {
+	deviceMapLock.RLock()
+	specs := buildPciCdiSpecs(deviceMap, pciNamespaceMap, iommuMap, getConfig().pciNamespaces())
+	deviceMapLock.RUnlock()
+	for _, spec := range specs {
+		if err := writeCdiSpec(spec); err != nil {
+			log.Printf("Failed to write CDI spec %s: %v", spec.Kind, err)
+		}
+	}
+}
+
+// updateVgpuCdiSpec writes the CDI spec of the vGPUs currently in the device
+// maps.
+func updateVgpuCdiSpec() {
+	deviceMapLock.RLock()
+	spec := buildVgpuCdiSpec(vGpuMap)
+	deviceMapLock.RUnlock()
+	if err := writeCdiSpec(spec); err != nil {
+		log.Printf("Failed to write CDI spec for vGPUs: %v", err)
+	}
+}
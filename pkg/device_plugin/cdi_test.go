@@ -0,0 +1,64 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func readCdiSpec(t *testing.T, class string) *cdiSpec {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(cdiSpecPath, "xdxct.com-"+class+".yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &cdiSpec{}
+	if err := yaml.Unmarshal(data, spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestCdiSpecs(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+	createVgpuMap()
+	updatePciCdiSpec()
+	updateVgpuCdiSpec()
+
+	vfio := cdiDeviceNode{Path: "/dev/vfio/vfio", Permissions: "rw"}
+	want := &cdiSpec{
+		Version:        cdiVersion,
+		Kind:           "xdxct.com/gpu",
+		ContainerEdits: cdiContainerEdits{DeviceNodes: []cdiDeviceNode{vfio}},
+		Devices: []cdiDevice{
+			{Name: "7", ContainerEdits: cdiContainerEdits{
+				Env:         []string{"PCI_RESOURCE_XDXCT_COM_1330_7=0000:3b:00.0,0000:3b:00.1"},
+				DeviceNodes: []cdiDeviceNode{{Path: "/dev/vfio/7", Permissions: "rw"}},
+			}},
+			{Name: "8", ContainerEdits: cdiContainerEdits{
+				Env:         []string{"PCI_RESOURCE_XDXCT_COM_1330_8=0000:3c:00.0,0000:3c:00.1"},
+				DeviceNodes: []cdiDeviceNode{{Path: "/dev/vfio/8", Permissions: "rw"}},
+			}},
+		},
+	}
+	if got := readCdiSpec(t, cdiClassGpu); !reflect.DeepEqual(got, want) {
+		t.Errorf("GPU spec = %+v, want %+v", got, want)
+	}
+
+	const uuid = "9d5c5a1e-1b4a-4e0a-8a3e-000000000002"
+	spec := readCdiSpec(t, cdiClassVgpu)
+	if spec.Kind != "xdxct.com/vgpu" || len(spec.Devices) != 2 {
+		t.Fatalf("vGPU spec = %+v, want two xdxct.com/vgpu devices", spec)
+	}
+	wantDevice := cdiDevice{Name: uuid, ContainerEdits: cdiContainerEdits{
+		Env:         []string{"MDEV_PCI_RESOURCE_XDXCT_COM_XGV_V0_1G_1_CORE_9D5C5A1E_1B4A_4E0A_8A3E_000000000002=" + uuid},
+		DeviceNodes: []cdiDeviceNode{{Path: "/dev/vfio/22", Permissions: "rw"}},
+	}}
+	if !reflect.DeepEqual(spec.Devices[1], wantDevice) {
+		t.Errorf("vGPU device = %+v, want %+v", spec.Devices[1], wantDevice)
+	}
+}
@@ -0,0 +1,485 @@
+package device_plugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigEnv names the configuration file when no --config flag is given.
+const ConfigEnv = "XDXCT_DEVICE_PLUGIN_CONFIG"
+
+// Config is the device plugin configuration. It is read from a YAML or JSON
+// file; every field that is left out keeps its default value.
+type Config struct {
+	// Selectors pick the PCI functions that are bound to Driver and advertised
+	// for passthrough under ResourceNamespace. A function is selected if it
+	// matches any selector.
+	Selectors []DeviceSelector `json:"selectors,omitempty"`
+	// DeviceSets select further PCI functions, each set advertised under its
+	// own namespace and resource name prefix. The first set or Selectors
+	// entry a function matches decides how it is advertised.
+	DeviceSets []DeviceSet `json:"deviceSets,omitempty"`
+	// Driver is the driver passthrough devices are bound to, unless their
+	// selector names another one.
+	Driver string `json:"driver,omitempty"`
+	// ResourceNamespace prefixes every resource name, e.g. xdxct.com/Pangu_A0.
+	ResourceNamespace string `json:"resourceNamespace,omitempty"`
+	// ResourceNames maps PCI device IDs (e.g. "1330") to the name passthrough
+	// devices are advertised under. Unmapped devices use their device ID. The
+	// prefix of a device set is prepended to either.
+	ResourceNames map[string]string `json:"resourceNames,omitempty"`
+	// MdevResourceNames maps vGPU type names (e.g. "XGV_V0_1G_1_CORE") to the
+	// name they are advertised under. Unmapped types use the type name.
+	MdevResourceNames map[string]string `json:"mdevResourceNames,omitempty"`
+	// MdevLayout is the desired number of vGPUs per type on each parent GPU,
+	// keyed by PCI address. Falls back to XDXCT_MDEV_LAYOUT.
+	MdevLayout map[string]map[string]int `json:"mdevLayout,omitempty"`
+	// VgpuAllocationPolicy is "pack" or "spread". Falls back to
+	// XDXCT_VGPU_ALLOCATION_POLICY.
+	VgpuAllocationPolicy string `json:"vgpuAllocationPolicy,omitempty"`
+	// HTTPAddress is where /metrics, /healthz and /readyz are served, e.g.
+	// ":8080". Empty disables the HTTP server.
+	HTTPAddress string `json:"httpAddress"`
+	// NodeLabels publishes the GPU inventory as labels on the node named by
+	// NODE_NAME, e.g. xdxct.com/gpu.count.
+	NodeLabels bool `json:"nodeLabels,omitempty"`
+	// Events records device health changes and rejected allocations as
+	// events on the node named by NODE_NAME and the pods using the device.
+	Events bool `json:"events,omitempty"`
+	// Paths are the sysfs and kubelet directories the plugin works on.
+	Paths Paths `json:"paths,omitempty"`
+}
+
+// DeviceSelector matches PCI functions by their sysfs vendor, device, class and
+// subsystem files. Values are hex without the 0x prefix; all but Vendor are
+// optional, and Class may be a 2 or 4 digit prefix (e.g. "03" for any display
+// controller).
+type DeviceSelector struct {
+	Vendor          string `json:"vendor"`
+	Device          string `json:"device,omitempty"`
+	Class           string `json:"class,omitempty"`
+	SubsystemVendor string `json:"subsystemVendor,omitempty"`
+	SubsystemDevice string `json:"subsystemDevice,omitempty"`
+	// Driver is the driver matching functions are bound to for passthrough,
+	// Config.Driver if empty.
+	Driver string `json:"driver,omitempty"`
+}
+
+// DeviceSet advertises the PCI functions matching any of its selectors under
+// its own namespace, e.g. example.com/accel-1234 for the prefix "accel-".
+type DeviceSet struct {
+	Selectors []DeviceSelector `json:"selectors"`
+	// ResourceNamespace defaults to Config.ResourceNamespace.
+	ResourceNamespace string `json:"resourceNamespace,omitempty"`
+	// ResourcePrefix is prepended to the resource names of the set.
+	ResourcePrefix string `json:"resourcePrefix,omitempty"`
+}
+
+// pciMatch is how a selected PCI function is bound and advertised.
+type pciMatch struct {
+	namespace string
+	prefix    string
+	driver    string
+}
+
+// pciIDs are the sysfs ids of a PCI function selectors match against.
+type pciIDs struct {
+	vendor          string
+	device          string
+	class           string
+	subsystemVendor string
+	subsystemDevice string
+}
+
+type Paths struct {
+	PciDevices    string `json:"pciDevices,omitempty"`
+	PciDrivers    string `json:"pciDrivers,omitempty"`
+	MdevDevices   string `json:"mdevDevices,omitempty"`
+	IommuGroups   string `json:"iommuGroups,omitempty"`
+	DevicePlugins string `json:"devicePlugins,omitempty"`
+	// PodResources holds the kubelet pod resources socket, used to report
+	// which devices are allocated.
+	PodResources string `json:"podResources,omitempty"`
+	// VfioDevices holds the VFIO group device nodes, checked before they are
+	// handed to a VM. They are always mounted from /dev/vfio on the host.
+	VfioDevices string `json:"vfioDevices,omitempty"`
+	// CdiSpecs is the directory the CDI specs of the devices are written to.
+	CdiSpecs string `json:"cdiSpecs,omitempty"`
+	// KernelCmdline and KernelModules are checked by the doctor command.
+	KernelCmdline string `json:"kernelCmdline,omitempty"`
+	KernelModules string `json:"kernelModules,omitempty"`
+}
+
+var (
+	hexIDReg        = regexp.MustCompile(`^[0-9a-f]{4}$`)
+	hexClassReg     = regexp.MustCompile(`^([0-9a-f]{2}){1,3}$`)
+	resourceNameReg = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	prefixReg       = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9_.]*$`)
+	namespaceReg    = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// DefaultConfig advertises Xdxct GPUs and their audio functions bound to
+// vfio-pci under xdxct.com, named after their PCI device ID or vGPU type.
+func DefaultConfig() *Config {
+	return &Config{
+		Selectors: []DeviceSelector{
+			{Vendor: "1eed", Class: "030000"},
+			{Vendor: "1eed", Class: "040300"},
+		},
+		Driver:               "vfio-pci",
+		ResourceNamespace:    "xdxct.com",
+		VgpuAllocationPolicy: allocationPolicyPack,
+		HTTPAddress:          ":8080",
+		Paths: Paths{
+			PciDevices:    "/sys/bus/pci/devices",
+			PciDrivers:    "/sys/bus/pci/drivers",
+			MdevDevices:   "/sys/bus/mdev/devices",
+			IommuGroups:   "/sys/kernel/iommu_groups",
+			DevicePlugins: "/var/lib/kubelet/device-plugins",
+			PodResources:  "/var/lib/kubelet/pod-resources",
+			VfioDevices:   "/dev/vfio",
+			CdiSpecs:      "/var/run/cdi",
+			KernelCmdline: "/proc/cmdline",
+			KernelModules: "/sys/module",
+		},
+	}
+}
+
+// LoadConfig reads and validates the configuration file at path. An empty path
+// yields the default configuration.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	// left empty so the environment can fill it in if the file does not
+	cfg.VgpuAllocationPolicy = ""
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config %s: %v", path, err)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+		}
+	}
+
+	if len(cfg.MdevLayout) == 0 {
+		if text := os.Getenv(mdevLayoutEnv); strings.TrimSpace(text) != "" {
+			layout, err := parseMdevLayout(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", mdevLayoutEnv, err)
+			}
+			cfg.MdevLayout = layout
+		}
+	}
+	if cfg.VgpuAllocationPolicy == "" {
+		cfg.VgpuAllocationPolicy = os.Getenv(vgpuAllocationPolicyEnv)
+	}
+	if cfg.VgpuAllocationPolicy == "" {
+		cfg.VgpuAllocationPolicy = allocationPolicyPack
+	}
+
+	cfg.normalize()
+	if err := cfg.Validate(); err != nil {
+		if path == "" {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) normalize() {
+	normalizeSelectors(c.Selectors)
+	for i := range c.DeviceSets {
+		normalizeSelectors(c.DeviceSets[i].Selectors)
+	}
+	names := make(map[string]string, len(c.ResourceNames))
+	for id, name := range c.ResourceNames {
+		names[normalizeHex(id)] = name
+	}
+	c.ResourceNames = names
+	layout := make(map[string]map[string]int, len(c.MdevLayout))
+	for parent, types := range c.MdevLayout {
+		layout[strings.ToLower(parent)] = types
+	}
+	c.MdevLayout = layout
+}
+
+func normalizeSelectors(selectors []DeviceSelector) {
+	for i := range selectors {
+		s := &selectors[i]
+		s.Vendor = normalizeHex(s.Vendor)
+		s.Device = normalizeHex(s.Device)
+		s.Class = normalizeHex(s.Class)
+		s.SubsystemVendor = normalizeHex(s.SubsystemVendor)
+		s.SubsystemDevice = normalizeHex(s.SubsystemDevice)
+	}
+}
+
+func normalizeHex(s string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "0x")
+}
+
+// Validate reports every problem in the configuration at once.
+func (c *Config) Validate() error {
+	var errs []string
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	selectors := len(c.Selectors)
+	checkSelectors := func(field string, list []DeviceSelector) {
+		for i, s := range list {
+			if !hexIDReg.MatchString(s.Vendor) {
+				addErr("%s[%d]: vendor %q is not a 4 digit hex id", field, i, s.Vendor)
+			}
+			for name, id := range map[string]string{"device": s.Device, "subsystemVendor": s.SubsystemVendor, "subsystemDevice": s.SubsystemDevice} {
+				if id != "" && !hexIDReg.MatchString(id) {
+					addErr("%s[%d]: %s %q is not a 4 digit hex id", field, i, name, id)
+				}
+			}
+			if s.Class != "" && !hexClassReg.MatchString(s.Class) {
+				addErr("%s[%d]: class %q is not a 2, 4 or 6 digit hex class", field, i, s.Class)
+			}
+		}
+	}
+	checkSelectors("selectors", c.Selectors)
+	for i, set := range c.DeviceSets {
+		field := fmt.Sprintf("deviceSets[%d]", i)
+		if len(set.Selectors) == 0 {
+			addErr("%s: at least one selector is required", field)
+		}
+		selectors += len(set.Selectors)
+		checkSelectors(field+".selectors", set.Selectors)
+		if set.ResourceNamespace != "" && !namespaceReg.MatchString(set.ResourceNamespace) {
+			addErr("%s: resourceNamespace %q is not a valid DNS subdomain", field, set.ResourceNamespace)
+		}
+		if set.ResourcePrefix != "" && !prefixReg.MatchString(set.ResourcePrefix) {
+			addErr("%s: resourcePrefix %q is not a valid resource name prefix", field, set.ResourcePrefix)
+		}
+	}
+	if selectors == 0 {
+		addErr("at least one device selector is required")
+	}
+	if c.Driver == "" {
+		addErr("driver must not be empty")
+	}
+	if !namespaceReg.MatchString(c.ResourceNamespace) {
+		addErr("resourceNamespace %q is not a valid DNS subdomain", c.ResourceNamespace)
+	}
+
+	// every resource gets its own socket, so passthrough devices and vGPUs
+	// must not share a name. Several device IDs or vGPU types may share one.
+	kinds := make(map[string]string)
+	checkName := func(kind string, key string, name string) {
+		if len(name) > 63 || !resourceNameReg.MatchString(name) {
+			addErr("%s[%s]: %q is not a valid resource name", kind, key, name)
+		}
+		if other, exists := kinds[name]; exists && other != kind {
+			addErr("%s[%s]: resource name %q is already used in %s", kind, key, name, other)
+		}
+		kinds[name] = kind
+	}
+	for _, id := range sortedKeys(c.ResourceNames) {
+		if !hexIDReg.MatchString(id) {
+			addErr("resourceNames: %q is not a 4 digit hex device id", id)
+		}
+		checkName("resourceNames", id, c.ResourceNames[id])
+	}
+	for _, mdevType := range sortedKeys(c.MdevResourceNames) {
+		checkName("mdevResourceNames", mdevType, c.MdevResourceNames[mdevType])
+	}
+
+	for parent, types := range c.MdevLayout {
+		if !pciAddrReg.MatchString(parent) {
+			addErr("mdevLayout: %q is not a PCI address", parent)
+		}
+		for mdevType, count := range types {
+			if count < 0 {
+				addErr("mdevLayout[%s]: negative count %d for %s", parent, count, mdevType)
+			}
+		}
+	}
+	if c.VgpuAllocationPolicy != allocationPolicyPack && c.VgpuAllocationPolicy != allocationPolicySpread {
+		addErr("vgpuAllocationPolicy %q must be %q or %q", c.VgpuAllocationPolicy, allocationPolicyPack, allocationPolicySpread)
+	}
+
+	if c.HTTPAddress != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPAddress); err != nil {
+			addErr("httpAddress %q is not a host:port address", c.HTTPAddress)
+		}
+	}
+
+	paths := map[string]string{
+		"paths.pciDevices":    c.Paths.PciDevices,
+		"paths.pciDrivers":    c.Paths.PciDrivers,
+		"paths.mdevDevices":   c.Paths.MdevDevices,
+		"paths.iommuGroups":   c.Paths.IommuGroups,
+		"paths.devicePlugins": c.Paths.DevicePlugins,
+		"paths.podResources":  c.Paths.PodResources,
+		"paths.vfioDevices":   c.Paths.VfioDevices,
+		"paths.cdiSpecs":      c.Paths.CdiSpecs,
+		"paths.kernelCmdline": c.Paths.KernelCmdline,
+		"paths.kernelModules": c.Paths.KernelModules,
+	}
+	for _, field := range sortedKeys(paths) {
+		if !filepath.IsAbs(paths[field]) {
+			addErr("%s %q must be an absolute path", field, paths[field])
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// matches reports whether the selector matches the given sysfs ids.
+func (s DeviceSelector) matches(ids pciIDs) bool {
+	return s.Vendor == ids.vendor &&
+		(s.Device == "" || s.Device == ids.device) &&
+		strings.HasPrefix(ids.class, s.Class) &&
+		(s.SubsystemVendor == "" || s.SubsystemVendor == ids.subsystemVendor) &&
+		(s.SubsystemDevice == "" || s.SubsystemDevice == ids.subsystemDevice)
+}
+
+// deviceSets returns Selectors as the first set followed by DeviceSets, with
+// the namespaces filled in.
+func (c *Config) deviceSets() []DeviceSet {
+	sets := []DeviceSet{{Selectors: c.Selectors, ResourceNamespace: c.ResourceNamespace}}
+	for _, set := range c.DeviceSets {
+		if set.ResourceNamespace == "" {
+			set.ResourceNamespace = c.ResourceNamespace
+		}
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// matchPciDevice returns how a function with the given ids is bound and
+// advertised, if any selector matches it.
+func (c *Config) matchPciDevice(ids pciIDs) (pciMatch, bool) {
+	for _, set := range c.deviceSets() {
+		for _, s := range set.Selectors {
+			if !s.matches(ids) {
+				continue
+			}
+			driver := s.Driver
+			if driver == "" {
+				driver = c.Driver
+			}
+			return pciMatch{namespace: set.ResourceNamespace, prefix: set.ResourcePrefix, driver: driver}, true
+		}
+	}
+	return pciMatch{}, false
+}
+
+// pciDrivers returns every driver passthrough devices are bound to.
+func (c *Config) pciDrivers() []string {
+	seen := map[string]bool{c.Driver: true}
+	drivers := []string{c.Driver}
+	for _, set := range c.deviceSets() {
+		for _, s := range set.Selectors {
+			if s.Driver != "" && !seen[s.Driver] {
+				seen[s.Driver] = true
+				drivers = append(drivers, s.Driver)
+			}
+		}
+	}
+	return drivers
+}
+
+// pciNamespaces returns every namespace passthrough devices are advertised under.
+func (c *Config) pciNamespaces() []string {
+	seen := make(map[string]bool)
+	var namespaces []string
+	for _, set := range c.deviceSets() {
+		if !seen[set.ResourceNamespace] {
+			seen[set.ResourceNamespace] = true
+			namespaces = append(namespaces, set.ResourceNamespace)
+		}
+	}
+	return namespaces
+}
+
+// pciResourceName returns the resource name passthrough devices with the
+// given PCI device ID are advertised under, without the prefix of their set.
+func (c *Config) pciResourceName(deviceID string) string {
+	if name, ok := c.ResourceNames[deviceID]; ok {
+		return name
+	}
+	return deviceID
+}
+
+// resourceName returns the resource name a function with the given PCI device
+// ID is advertised under.
+func (m pciMatch) resourceName(deviceID string) string {
+	return m.prefix + getConfig().pciResourceName(deviceID)
+}
+
+// mdevResourceName returns the resource name vGPUs of the given type are
+// advertised under.
+func (c *Config) mdevResourceName(mdevType string) string {
+	if name, ok := c.MdevResourceNames[mdevType]; ok {
+		return name
+	}
+	return mdevType
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pluginConfig is the configuration in effect, see SetConfig. It is swapped
+// as a whole on reload, so readers go through getConfig and never modify it.
+var pluginConfig = DefaultConfig()
+var configLock sync.RWMutex
+
+func getConfig() *Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return pluginConfig
+}
+
+// pciDriverPath is the sysfs directory of a driver passthrough devices are bound to.
+func pciDriverPath(driver string) string {
+	return filepath.Join(getConfig().Paths.PciDrivers, driver)
+}
+
+// SetConfig makes cfg the configuration in effect. It must be called before
+// InitiateDevicePlugin or any of the vfio commands, the paths and the namespace
+// are read without a lock afterwards.
+func SetConfig(cfg *Config) {
+	swapConfig(cfg)
+
+	basePciPath = cfg.Paths.PciDevices
+	vGpuBasePath = cfg.Paths.MdevDevices
+	iommuGroupBasePath = cfg.Paths.IommuGroups
+	devicePluginPath = cfg.Paths.DevicePlugins
+	vfioGroupPath = cfg.Paths.VfioDevices
+	cdiSpecPath = cfg.Paths.CdiSpecs
+	kubeletSocket = filepath.Join(cfg.Paths.DevicePlugins, filepath.Base(pluginapi.KubeletSocket))
+	DeviceNamespace = cfg.ResourceNamespace
+}
+
+// swapConfig replaces the configuration in effect while the daemon runs. The
+// paths and the namespace of cfg must be those already in effect.
+func swapConfig(cfg *Config) {
+	configLock.Lock()
+	pluginConfig = cfg
+	configLock.Unlock()
+}
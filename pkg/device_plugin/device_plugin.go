@@ -1,21 +1,21 @@
 package device_plugin
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	klog "k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-const (
-	xdxctVendorId   = "1eed"
-	xdxctPGPUDriver = "vfio-pci"
-)
-
 type XdxctGpuDevice struct {
 	addr string
 }
@@ -23,87 +23,233 @@ type XdxctGpuDevice struct {
 // iommuMap key: iommu_group value: pcie-addr
 var iommuMap map[string][]XdxctGpuDevice
 
-// deviceMap key: deviceID value: iommu_group
+// deviceMap key: resource name value: iommu_group
 var deviceMap map[string][]string
 
+// pciNamespaceMap key: resource name in deviceMap value: the namespace it is advertised under
+var pciNamespaceMap map[string]string
+
 // key: vGpu type value: the list of vgpu uuid
 var vGpuMap map[string][]XdxctGpuDevice
 
 // key: xdxct Gpu id value: the list of vgpu uuid
 var gpuVgpuMap map[string][]string
 
+// deviceMapLock guards iommuMap, deviceMap, pciNamespaceMap, vGpuMap and gpuVgpuMap, which are
+// replaced wholesale whenever discovery runs again.
+var deviceMapLock sync.RWMutex
+
 var basePciPath = "/sys/bus/pci/devices"
 
 var vGpuBasePath = "/sys/bus/mdev/devices"
 
+var iommuGroupBasePath = "/sys/kernel/iommu_groups"
+
+var devicePluginPath = pluginapi.DevicePluginPath
+
+// vfioGroupPath is where the plugin sees the VFIO group nodes of the host
+var vfioGroupPath = vfioDevicePath
+
+var kubeletSocket = pluginapi.KubeletSocket
+
+// pciPlugins key: resource name value: the running passthrough device plugin
+var pciPlugins = make(map[string]*GenericDevicePlugin)
+var pciPluginsLock sync.Mutex
+
+// vgpuPlugins key: resource name value: the running vGPU device plugin
+var vgpuPlugins = make(map[string]*GenericDevicePlugin)
+var vgpuPluginsLock sync.Mutex
+
 var readLink = readLinkFunc
-var stop = make(chan struct{})
 
-func InitiateDevicePlugin() {
+// rootCtx is canceled by Shutdown. Every device plugin runs under a context
+// derived from it, the watchers and the HTTP server end with it as well.
+var rootCtx, rootCancel = context.WithCancel(context.Background())
+
+// background tracks the watchers and the HTTP server, which return once
+// rootCtx is canceled.
+var background sync.WaitGroup
+
+// Shutdown makes InitiateDevicePlugin stop every device plugin and return.
+func Shutdown() {
+	rootCancel()
+}
+
+func goBackground(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+// InitiateDevicePlugin discovers the devices, starts a device plugin per
+// resource and keeps them up to date until the process exits. If configPath is
+// not empty, changes to that file are applied without a restart. It returns
+// after Shutdown, with an error if not every plugin could be cleaned up.
+func InitiateDevicePlugin(configPath string) error {
+	// up before discovery, which may take a while when vGPUs are created
+	if addr := getConfig().HTTPAddress; addr != "" {
+		goBackground(func() { serveHTTP(addr, rootCtx.Done()) })
+	}
 	createIommuDeviceMap()
+	if layout := getConfig().MdevLayout; len(layout) > 0 {
+		if err := applyMdevLayout(layout); err != nil {
+			log.Printf("Failed to apply mdev layout: %v", err)
+		}
+	}
 	createVgpuMap()
-	createDevicePlugins()
+	return createDevicePlugins(configPath)
 }
 
-func createDevicePlugins() {
-	var devicePlugins []*GenericDevicePlugin
-	var vgpuDevicePlugins []*GenericVgpuDevicePlugin
-	var devs []*pluginapi.Device
-	var deviceName string
+func createDevicePlugins(configPath string) error {
 	log.Printf("Device Map %s", deviceMap)
-	for k, v := range deviceMap {
-		devs = nil
-		for _, dev := range v {
-			devs = append(devs, &pluginapi.Device{
-				ID:     dev,
-				Health: pluginapi.Healthy,
-			})
-		}
-		deviceName = k
-		log.Printf("Device Name: %s", deviceName)
-		dp := NewGenericaDevicePlugin(deviceName, "/sys/kernel/iommu_groups/", devs)
-		err := startDevicePlugin(dp)
-		if err != nil {
-			log.Printf("Error starting %s device plugin: %v", dp.deviceName, err)
-		} else {
-			devicePlugins = append(devicePlugins, dp)
-		}
+	updatePciCdiSpec()
+	updateVgpuCdiSpec()
+	startKubernetesIntegrations(getConfig())
+
+	pciPluginsLock.Lock()
+	for k := range pciResources(deviceMap) {
+		startPciDevicePlugin(k)
 	}
+	pciPluginsLock.Unlock()
 
-	for k, v := range vGpuMap {
-		devs = nil
-		for _, dev := range v {
-			devs = append(devs, &pluginapi.Device{
-				ID:     dev.addr,
-				Health: pluginapi.Healthy,
-			})
-		}
-		deviceName = k
-		log.Printf("vGPU Device name: %s", deviceName)
-		dp := NewGenericaVgpuDevicePlugin(deviceName, vGpuBasePath, devs)
-		err := startVgpuDevicePlugin(dp)
-		if err != nil {
-			log.Printf("Error starting %s device plugin: %v", dp.deviceName, err)
-		} else {
-			vgpuDevicePlugins = append(vgpuDevicePlugins, dp)
-		}
+	vgpuPluginsLock.Lock()
+	for k := range vgpuResources(vGpuMap) {
+		startVgpuDevicePlugin(k)
+	}
+	vgpuPluginsLock.Unlock()
+
+	goBackground(func() { watchDevices(rootCtx.Done()) })
+	if configPath != "" {
+		goBackground(func() { watchConfig(configPath, rootCtx.Done()) })
 	}
 
-	<-stop
+	<-rootCtx.Done()
 	log.Println("Shutting down device plugin controller")
-	for _, v := range devicePlugins {
-		v.Stop()
+	var errs []string
+	stopAll := func(lock sync.Locker, plugins map[string]*GenericDevicePlugin) {
+		lock.Lock()
+		defer lock.Unlock()
+		for name, dp := range plugins {
+			if err := dp.Stop(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			}
+			delete(plugins, name)
+		}
 	}
+	stopAll(&pciPluginsLock, pciPlugins)
+	stopAll(&vgpuPluginsLock, vgpuPlugins)
+	background.Wait()
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("failed to stop device plugins: %s", strings.Join(errs, "; "))
+	}
+	log.Println("All device plugins stopped")
+	return nil
+}
 
-	for _, v := range vgpuDevicePlugins {
-		v.Stop()
+// startPciDevicePlugin starts a passthrough device plugin for the resource and
+// records it in pciPlugins. The caller must hold pciPluginsLock.
+func startPciDevicePlugin(deviceName string) {
+	log.Printf("Device Name: %s", deviceName)
+	dp := NewGenericaDevicePlugin(deviceName, iommuGroupBasePath)
+	err := startDevicePlugin(dp)
+	if err != nil {
+		log.Printf("Error starting %s device plugin: %v", dp.deviceName, err)
+		return
 	}
+	pciPlugins[deviceName] = dp
 }
 
-// Discovers all xdxct gpus which are loaded with VFIO-PCI driver and create corresponding maps
+// startVgpuDevicePlugin starts a vGPU device plugin for the resource and
+// records it in vgpuPlugins. The caller must hold vgpuPluginsLock.
+func startVgpuDevicePlugin(deviceName string) {
+	log.Printf("vGPU Device name: %s", deviceName)
+	dp := NewGenericaVgpuDevicePlugin(deviceName, vGpuBasePath)
+	err := startDevicePlugin(dp)
+	if err != nil {
+		log.Printf("Error starting %s device plugin: %v", dp.deviceName, err)
+		return
+	}
+	vgpuPlugins[deviceName] = dp
+}
+
+// pciResources returns the IOMMU groups of every resource in deviceMap, sorted.
+func pciResources(devices map[string][]string) map[string][]string {
+	resources := make(map[string][]string, len(devices))
+	for name, iommuGroups := range devices {
+		groups := append([]string(nil), iommuGroups...)
+		sort.Strings(groups)
+		resources[name] = groups
+	}
+	return resources
+}
+
+// vgpuResources groups the vGPUs in vGpuMap by the resource name their type
+// is advertised under.
+func vgpuResources(vgpus map[string][]XdxctGpuDevice) map[string][]XdxctGpuDevice {
+	resources := make(map[string][]XdxctGpuDevice)
+	for mdevType, devs := range vgpus {
+		name := getConfig().mdevResourceName(mdevType)
+		resources[name] = append(resources[name], devs...)
+	}
+	for _, devs := range resources {
+		sort.Slice(devs, func(i, j int) bool { return devs[i].addr < devs[j].addr })
+	}
+	return resources
+}
+
+// buildPciDevices describes each IOMMU group with the NUMA nodes of its functions.
+func buildPciDevices(iommuGroups []string, iommus map[string][]XdxctGpuDevice) []*pluginapi.Device {
+	var devs []*pluginapi.Device
+	for _, group := range iommuGroups {
+		var addrs []string
+		for _, dev := range iommus[group] {
+			addrs = append(addrs, dev.addr)
+		}
+		devs = append(devs, &pluginapi.Device{
+			ID:       group,
+			Health:   pluginapi.Healthy,
+			Topology: numaTopologyInfo(addrs),
+		})
+	}
+	return devs
+}
+
+// buildVgpuDevices describes each vGPU with the NUMA node of its parent GPU.
+func buildVgpuDevices(vgpus []XdxctGpuDevice, gpuVgpus map[string][]string) []*pluginapi.Device {
+	parents := vgpuParents(gpuVgpus)
+	var devs []*pluginapi.Device
+	for _, vgpu := range vgpus {
+		var addrs []string
+		if parent, ok := parents[vgpu.addr]; ok && parent != "" {
+			addrs = append(addrs, parent)
+		}
+		devs = append(devs, &pluginapi.Device{
+			ID:       vgpu.addr,
+			Health:   pluginapi.Healthy,
+			Topology: numaTopologyInfo(addrs),
+		})
+	}
+	return devs
+}
+
+// Discovers all selected PCI devices bound to their passthrough driver and create corresponding maps
 func createIommuDeviceMap() {
-	iommuMap = make(map[string][]XdxctGpuDevice)
-	deviceMap = make(map[string][]string)
+	iommus, devices, namespaces := discoverIommuDevices()
+	deviceMapLock.Lock()
+	iommuMap, deviceMap, pciNamespaceMap = iommus, devices, namespaces
+	deviceMapLock.Unlock()
+}
+
+// discoverIommuDevices walks the PCI bus and returns freshly built iommuMap,
+// deviceMap and pciNamespaceMap contents without touching the package globals.
+func discoverIommuDevices() (map[string][]XdxctGpuDevice, map[string][]string, map[string]string) {
+	defer observeDiscovery("pci", time.Now())
+	iommuMap := make(map[string][]XdxctGpuDevice)
+	deviceMap := make(map[string][]string)
+	namespaces := make(map[string]string)
 	// find pci devices
 	filepath.Walk(basePciPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -114,21 +260,16 @@ func createIommuDeviceMap() {
 			return nil
 		}
 
-		vendorID, err := readIDFromFile(basePciPath, info.Name(), "vendor")
-		if err != nil {
-			log.Println("Cloud not get driver for device", info.Name())
-			return nil
-		}
-
-		if vendorID == xdxctVendorId {
-			log.Println("Xdxct device vendorID:", info.Name())
+		match, ok := selectPciDevice(info.Name())
+		if ok {
+			log.Println("Selected PCI device:", info.Name())
 			driver, err := readLink(basePciPath, info.Name(), "driver")
 			if err != nil {
 				log.Println("Failed to get driver for device", info.Name())
 				return nil
 			}
-			if driver == xdxctPGPUDriver {
-				log.Println("Xdxct device driver vfio-pci:", info.Name())
+			if driver == match.driver {
+				log.Printf("PCI device %s bound to %s", info.Name(), driver)
 				iommuGroup, err := readLink(basePciPath, info.Name(), "iommu_group")
 				if err != nil {
 					log.Println("Failed to get IOMMU Group for device", info.Name())
@@ -141,19 +282,37 @@ func createIommuDeviceMap() {
 					if err != nil {
 						log.Printf("Failed to get %s deviceID of pci devices", info.Name())
 					}
-					deviceMap[deviceID] = append(deviceMap[deviceID], iommuGroup)
+					name := match.resourceName(deviceID)
+					// every resource has a single socket, named after it
+					if namespace, exists := namespaces[name]; exists && namespace != match.namespace {
+						log.Printf("Resource name %s is used in %s and %s, not advertising IOMMU group %s", name, namespace, match.namespace, iommuGroup)
+					} else {
+						namespaces[name] = match.namespace
+						deviceMap[name] = append(deviceMap[name], iommuGroup)
+					}
 				}
 				iommuMap[iommuGroup] = append(iommuMap[iommuGroup], XdxctGpuDevice{info.Name()})
 			}
 		}
 		return nil
 	})
+	return iommuMap, deviceMap, namespaces
 }
 
 // Discovers all xdxct vgpus and create corresponding maps
 func createVgpuMap() {
-	vGpuMap = make(map[string][]XdxctGpuDevice)
-	gpuVgpuMap = make(map[string][]string)
+	vgpus, gpuVgpus := discoverVgpus()
+	deviceMapLock.Lock()
+	vGpuMap, gpuVgpuMap = vgpus, gpuVgpus
+	deviceMapLock.Unlock()
+}
+
+// discoverVgpus walks the mdev bus and returns freshly built vGpuMap and
+// gpuVgpuMap contents without touching the package globals.
+func discoverVgpus() (map[string][]XdxctGpuDevice, map[string][]string) {
+	defer observeDiscovery("mdev", time.Now())
+	vGpuMap := make(map[string][]XdxctGpuDevice)
+	gpuVgpuMap := make(map[string][]string)
 
 	filepath.Walk(vGpuBasePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -179,6 +338,18 @@ func createVgpuMap() {
 		log.Printf("VGPU MAP is %s", vGpuMap)
 		return nil
 	})
+	return vGpuMap, gpuVgpuMap
+}
+
+// vgpuParents inverts gpuVgpuMap into key: vgpu uuid value: parent GPU.
+func vgpuParents(gpuVgpus map[string][]string) map[string]string {
+	parents := make(map[string]string)
+	for gpu, uuids := range gpuVgpus {
+		for _, uuid := range uuids {
+			parents[uuid] = gpu
+		}
+	}
+	return parents
 }
 
 func readIDFromFile(basePciPath string, deviceAddress string, property string) (string, error) {
@@ -232,13 +403,27 @@ func readGpuIDFromVgpu(basePath string, deviceAddress string) (string, error) {
 	return str, nil
 }
 func getIommuMap() map[string][]XdxctGpuDevice {
+	deviceMapLock.RLock()
+	defer deviceMapLock.RUnlock()
 	return iommuMap
 }
 
-func startDevicePlugin(dp *GenericDevicePlugin) error {
-	return dp.Start(stop)
+// pciNamespace returns the namespace the passthrough resource is advertised under.
+func pciNamespace(deviceName string) string {
+	deviceMapLock.RLock()
+	defer deviceMapLock.RUnlock()
+	if namespace, ok := pciNamespaceMap[deviceName]; ok {
+		return namespace
+	}
+	return DeviceNamespace
+}
+
+func getGpuVgpuMap() map[string][]string {
+	deviceMapLock.RLock()
+	defer deviceMapLock.RUnlock()
+	return gpuVgpuMap
 }
 
-func startVgpuDevicePlugin(dp *GenericVgpuDevicePlugin) error {
-	return dp.Start(stop)
+func startDevicePlugin(dp *GenericDevicePlugin) error {
+	return dp.Start(rootCtx)
 }
@@ -0,0 +1,162 @@
+package device_plugin
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestHost builds a host with two passthrough GPUs, each sharing its IOMMU
+// group with an audio function, a GPU carrying vGPUs and unrelated devices.
+func newTestHost(t *testing.T) *fakeSysfs {
+	s := newFakeSysfs(t)
+	s.addPciDevice(pciDevice{addr: "0000:3b:00.0", vendor: "1eed", device: "1330", class: "030000", driver: "vfio-pci", group: "7", numa: 0})
+	s.addPciDevice(pciDevice{addr: "0000:3b:00.1", vendor: "1eed", device: "1331", class: "040300", driver: "vfio-pci", group: "7", numa: 0})
+	s.addPciDevice(pciDevice{addr: "0000:3c:00.0", vendor: "1eed", device: "1330", class: "030000", driver: "vfio-pci", group: "8", numa: 1})
+	s.addPciDevice(pciDevice{addr: "0000:3c:00.1", vendor: "1eed", device: "1331", class: "040300", driver: "vfio-pci", group: "8", numa: 1})
+	// bound to the host driver for vGPUs, not advertised for passthrough
+	s.addPciDevice(pciDevice{addr: "0000:5e:00.0", vendor: "1eed", device: "1330", class: "030000", driver: "xdxgpu", group: "20", numa: 1})
+	// not an Xdxct device
+	s.addPciDevice(pciDevice{addr: "0000:00:1f.0", vendor: "8086", device: "a1c8", class: "060100", driver: "vfio-pci", group: "30", numa: 0})
+
+	s.addMdevType("0000:5e:00.0", "xgv-XGV_V0_1G_1_CORE", "XGV_V0_1G_1_CORE", 2)
+	s.addMdev("0000:5e:00.0", "xgv-XGV_V0_1G_1_CORE", "9d5c5a1e-1b4a-4e0a-8a3e-000000000001", "21")
+	s.addMdev("0000:5e:00.0", "xgv-XGV_V0_1G_1_CORE", "9d5c5a1e-1b4a-4e0a-8a3e-000000000002", "22")
+	return s
+}
+
+func TestDiscoverIommuDevices(t *testing.T) {
+	newTestHost(t)
+
+	iommus, devices, namespaces := discoverIommuDevices()
+
+	wantDevices := map[string][]string{"1330": {"7", "8"}}
+	if !reflect.DeepEqual(devices, wantDevices) {
+		t.Errorf("deviceMap = %v, want %v", devices, wantDevices)
+	}
+	if want := map[string]string{"1330": "xdxct.com"}; !reflect.DeepEqual(namespaces, want) {
+		t.Errorf("pciNamespaceMap = %v, want %v", namespaces, want)
+	}
+	wantIommus := map[string][]XdxctGpuDevice{
+		"7": {{"0000:3b:00.0"}, {"0000:3b:00.1"}},
+		"8": {{"0000:3c:00.0"}, {"0000:3c:00.1"}},
+	}
+	if !reflect.DeepEqual(iommus, wantIommus) {
+		t.Errorf("iommuMap = %v, want %v", iommus, wantIommus)
+	}
+}
+
+// newAcceleratorHost adds accelerators of another vendor to newTestHost: a
+// matching one bound to vfio-pci, one with another subsystem device and one
+// bound to a vendor specific VFIO driver.
+func newAcceleratorHost(t *testing.T) *fakeSysfs {
+	s := newTestHost(t)
+	s.addPciDevice(pciDevice{addr: "0000:81:00.0", vendor: "abcd", device: "1234", class: "120000", driver: "vfio-pci", group: "40", subsystemVendor: "abcd", subsystemDevice: "0001"})
+	s.addPciDevice(pciDevice{addr: "0000:82:00.0", vendor: "abcd", device: "1234", class: "120000", driver: "vfio-pci", group: "41", subsystemVendor: "abcd", subsystemDevice: "0002"})
+	s.addPciDevice(pciDevice{addr: "0000:83:00.0", vendor: "abcd", device: "5678", class: "120000", driver: "abcd-vfio-pci", group: "42"})
+	s.cfg.DeviceSets = []DeviceSet{{
+		Selectors: []DeviceSelector{
+			{Vendor: "abcd", Device: "1234", SubsystemDevice: "0001"},
+			{Vendor: "abcd", Device: "5678", Driver: "abcd-vfio-pci"},
+		},
+		ResourceNamespace: "example.com",
+		ResourcePrefix:    "accel-",
+	}}
+	if err := s.cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	SetConfig(s.cfg)
+	return s
+}
+
+func TestDiscoverDeviceSets(t *testing.T) {
+	newAcceleratorHost(t)
+
+	_, devices, namespaces := discoverIommuDevices()
+
+	wantDevices := map[string][]string{"1330": {"7", "8"}, "accel-1234": {"40"}, "accel-5678": {"42"}}
+	if !reflect.DeepEqual(devices, wantDevices) {
+		t.Errorf("deviceMap = %v, want %v", devices, wantDevices)
+	}
+	wantNamespaces := map[string]string{"1330": "xdxct.com", "accel-1234": "example.com", "accel-5678": "example.com"}
+	if !reflect.DeepEqual(namespaces, wantNamespaces) {
+		t.Errorf("pciNamespaceMap = %v, want %v", namespaces, wantNamespaces)
+	}
+}
+
+func TestDiscoverVgpus(t *testing.T) {
+	newTestHost(t)
+
+	vgpus, gpuVgpus := discoverVgpus()
+
+	wantVgpus := map[string][]XdxctGpuDevice{
+		"XGV_V0_1G_1_CORE": {{"9d5c5a1e-1b4a-4e0a-8a3e-000000000001"}, {"9d5c5a1e-1b4a-4e0a-8a3e-000000000002"}},
+	}
+	if !reflect.DeepEqual(vgpus, wantVgpus) {
+		t.Errorf("vGpuMap = %v, want %v", vgpus, wantVgpus)
+	}
+	wantGpuVgpus := map[string][]string{
+		"0000:5e:00.0": {"9d5c5a1e-1b4a-4e0a-8a3e-000000000001", "9d5c5a1e-1b4a-4e0a-8a3e-000000000002"},
+	}
+	if !reflect.DeepEqual(gpuVgpus, wantGpuVgpus) {
+		t.Errorf("gpuVgpuMap = %v, want %v", gpuVgpus, wantGpuVgpus)
+	}
+}
+
+func TestBuildPciDevicesTopology(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+
+	devs := NewGenericaDevicePlugin("1330", iommuGroupBasePath).devices()
+	if len(devs) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devs))
+	}
+	for i, want := range []int64{0, 1} {
+		if devs[i].Topology == nil || len(devs[i].Topology.Nodes) != 1 || devs[i].Topology.Nodes[0].ID != want {
+			t.Errorf("device %s topology = %v, want NUMA node %d", devs[i].ID, devs[i].Topology, want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	newTestHost(t)
+	kubelet := newFakeKubelet(t)
+	rootCtx, rootCancel = context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- InitiateDevicePlugin("") }()
+
+	registered := make(map[string]bool)
+	for len(registered) < 2 {
+		registered[kubelet.waitForRegistration(t).ResourceName] = true
+	}
+	pciPluginsLock.Lock()
+	dp := pciPlugins["1330"]
+	pciPluginsLock.Unlock()
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	recvDevices(t, stream)
+
+	Shutdown()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("InitiateDevicePlugin() = %v, want a clean shutdown", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for shutdown")
+	}
+
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("ListAndWatch ended with %v, want the stream closed cleanly", err)
+	}
+	socks, _ := filepath.Glob(filepath.Join(devicePluginPath, "kubevirt-*.sock"))
+	if len(socks) != 0 {
+		t.Errorf("plugin sockets left behind: %v", socks)
+	}
+	if len(pciPlugins) != 0 || len(vgpuPlugins) != 0 {
+		t.Errorf("plugins left running: %v %v", pciPlugins, vgpuPlugins)
+	}
+}
@@ -0,0 +1,97 @@
+package device_plugin
+
+import (
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceState holds the devices a plugin advertises. Every change bumps the
+// version and wakes all watchers, so any number of ListAndWatch streams follow
+// it without the health checks ever waiting for one of them.
+type deviceState struct {
+	lock    sync.Mutex
+	devs    []*pluginapi.Device
+	version uint64
+	changed chan struct{} // closed and replaced on every change
+}
+
+func newDeviceState(devs []*pluginapi.Device) *deviceState {
+	return &deviceState{
+		devs:    devs,
+		version: 1,
+		changed: make(chan struct{}),
+	}
+}
+
+// snapshot returns a copy of the devices, their version and a channel that is
+// closed on the next change.
+func (s *deviceState) snapshot() ([]*pluginapi.Device, uint64, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	devs := make([]*pluginapi.Device, 0, len(s.devs))
+	for _, dev := range s.devs {
+		d := *dev
+		devs = append(devs, &d)
+	}
+	return devs, s.version, s.changed
+}
+
+func (s *deviceState) ids() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return deviceIDsOf(s.devs)
+}
+
+// health returns the health of one device, empty for unknown devices.
+func (s *deviceState) health(id string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, dev := range s.devs {
+		if dev.ID == id {
+			return dev.Health
+		}
+	}
+	return ""
+}
+
+// setHealth changes the health of one device and reports whether it changed.
+// Unknown devices and unchanged health are ignored.
+func (s *deviceState) setHealth(id string, health string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changed := false
+	for _, dev := range s.devs {
+		if dev.ID == id && dev.Health != health {
+			dev.Health = health
+			s.bump()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// replace swaps in the devices of a rediscovery. Devices that were already
+// advertised keep their current health.
+func (s *deviceState) replace(devs []*pluginapi.Device) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	health := make(map[string]string, len(s.devs))
+	for _, dev := range s.devs {
+		health[dev.ID] = dev.Health
+	}
+	for _, dev := range devs {
+		if h, ok := health[dev.ID]; ok {
+			dev.Health = h
+		}
+	}
+	s.devs = devs
+	s.bump()
+}
+
+// bump publishes a change, the caller must hold lock.
+func (s *deviceState) bump() {
+	s.version++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
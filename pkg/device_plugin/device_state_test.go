@@ -0,0 +1,54 @@
+package device_plugin
+
+import (
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDeviceStateVersions(t *testing.T) {
+	state := newDeviceState([]*pluginapi.Device{
+		{ID: "7", Health: pluginapi.Healthy},
+		{ID: "8", Health: pluginapi.Healthy},
+	})
+	devs, version, changed := state.snapshot()
+
+	// snapshots are copies, changing one does not change the state
+	devs[0].Health = pluginapi.Unhealthy
+	if got, _, _ := state.snapshot(); got[0].Health != pluginapi.Healthy {
+		t.Errorf("snapshot shares devices with the state")
+	}
+
+	state.setHealth("7", pluginapi.Healthy)
+	if _, v, _ := state.snapshot(); v != version {
+		t.Errorf("unchanged health bumped the version to %d", v)
+	}
+
+	state.setHealth("7", pluginapi.Unhealthy)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("watchers were not woken by a health change")
+	}
+	_, next, changed := state.snapshot()
+	if next <= version {
+		t.Errorf("version %d after a health change, want more than %d", next, version)
+	}
+
+	state.replace([]*pluginapi.Device{
+		{ID: "7", Health: pluginapi.Healthy},
+		{ID: "9", Health: pluginapi.Healthy},
+	})
+	select {
+	case <-changed:
+	default:
+		t.Fatal("watchers were not woken by a rediscovery")
+	}
+	got, _, _ := state.snapshot()
+	if got[0].Health != pluginapi.Unhealthy {
+		t.Errorf("device 7 lost its health on rediscovery")
+	}
+	if ids := state.ids(); len(ids) != 2 || ids[1] != "9" {
+		t.Errorf("ids = %v, want [7 9]", ids)
+	}
+}
@@ -0,0 +1,185 @@
+package device_plugin
+
+import (
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// sysfs does not emit inotify events for every bind/unbind or mdev
+	// created, so the PCI and mdev buses are also rescanned periodically.
+	discoveryResyncInterval = 30 * time.Second
+	// bind/unbind and mdev create/remove produce bursts of events, wait for
+	// them to settle before rescanning.
+	discoverySettleDelay = time.Second
+)
+
+// watchDevices keeps the passthrough device plugins in sync with the devices
+// currently bound to their passthrough driver, and the vGPU device plugins with
+// the mdevs that exist, until stop is closed. vGPUs created or removed out of
+// band are picked up the same way as GPUs being bound.
+func watchDevices(stop <-chan struct{}) {
+	var events <-chan fsnotify.Event
+	var errors <-chan error
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Unable to create fsnotify watcher for device discovery, falling back to polling: %v", err)
+	} else {
+		defer watcher.Close()
+		dirs := []string{basePciPath, vGpuBasePath}
+		for _, driver := range getConfig().pciDrivers() {
+			dirs = append(dirs, pciDriverPath(driver))
+		}
+		for _, dir := range dirs {
+			if err := watcher.Add(dir); err != nil {
+				log.Printf("Unable to watch %s for device discovery: %v", dir, err)
+			}
+		}
+		events = watcher.Events
+		errors = watcher.Errors
+	}
+
+	ticker := time.NewTicker(discoveryResyncInterval)
+	defer ticker.Stop()
+	settle := time.NewTimer(discoverySettleDelay)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			log.Printf("Device discovery event: %s %v", event.Name, event.Op)
+			settle.Reset(discoverySettleDelay)
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			log.Printf("Device discovery watcher error: %v", err)
+		case <-settle.C:
+			refreshPciDevicePlugins()
+			refreshVgpuDevicePlugins()
+		case <-ticker.C:
+			refreshPciDevicePlugins()
+			refreshVgpuDevicePlugins()
+		}
+	}
+}
+
+// discoveryLock serializes rediscovery, so the PCI watcher and a config reload
+// never discover, swap the device maps and reconcile the plugins at once.
+var discoveryLock sync.Mutex
+
+// refreshPciDevicePlugins rescans the PCI bus and, if the inventory changed,
+// reconciles the running passthrough device plugins with the result. Otherwise
+// the plugins are still reconciled, so a plugin that failed to start is tried
+// again and a changed NUMA node, which the inventory does not hold, reaches
+// kubelet.
+func refreshPciDevicePlugins() {
+	discoveryLock.Lock()
+	defer discoveryLock.Unlock()
+	iommus, devices, namespaces := discoverIommuDevices()
+
+	deviceMapLock.Lock()
+	changed := !reflect.DeepEqual(iommus, iommuMap) || !reflect.DeepEqual(devices, deviceMap) ||
+		!reflect.DeepEqual(namespaces, pciNamespaceMap)
+	iommuMap, deviceMap, pciNamespaceMap = iommus, devices, namespaces
+	deviceMapLock.Unlock()
+
+	if !changed {
+		syncPciDevicePlugins(devices)
+		return
+	}
+	log.Printf("PCI device inventory changed, Device Map %s", devices)
+	reconcilePciDevicePlugins(devices)
+}
+
+func reconcilePciDevicePlugins(devices map[string][]string) {
+	updatePciCdiSpec()
+	updateNodeLabels()
+	syncPciDevicePlugins(devices)
+}
+
+func syncPciDevicePlugins(devices map[string][]string) {
+	resources := make(map[string]string)
+	for name := range pciResources(devices) {
+		resources[name] = pciNamespace(name)
+	}
+	pciPluginsLock.Lock()
+	defer pciPluginsLock.Unlock()
+	reconcileDevicePlugins(pciPlugins, resources, startPciDevicePlugin)
+}
+
+// refreshVgpuDevicePlugins is refreshPciDevicePlugins for the mdev bus and the
+// vGPU device plugins.
+func refreshVgpuDevicePlugins() {
+	discoveryLock.Lock()
+	defer discoveryLock.Unlock()
+	vgpus, gpuVgpus := discoverVgpus()
+
+	deviceMapLock.Lock()
+	changed := !reflect.DeepEqual(vgpus, vGpuMap) || !reflect.DeepEqual(gpuVgpus, gpuVgpuMap)
+	vGpuMap, gpuVgpuMap = vgpus, gpuVgpus
+	deviceMapLock.Unlock()
+
+	if !changed {
+		syncVgpuDevicePlugins(vgpus)
+		return
+	}
+	log.Printf("vGPU inventory changed, vGPU Map %v", vgpus)
+	reconcileVgpuDevicePlugins(vgpus)
+}
+
+func reconcileVgpuDevicePlugins(vgpus map[string][]XdxctGpuDevice) {
+	updateVgpuCdiSpec()
+	updateNodeLabels()
+	syncVgpuDevicePlugins(vgpus)
+}
+
+func syncVgpuDevicePlugins(vgpus map[string][]XdxctGpuDevice) {
+	resources := make(map[string]string)
+	for name := range vgpuResources(vgpus) {
+		resources[name] = DeviceNamespace
+	}
+	vgpuPluginsLock.Lock()
+	defer vgpuPluginsLock.Unlock()
+	reconcileDevicePlugins(vgpuPlugins, resources, startVgpuDevicePlugin)
+}
+
+// reconcileDevicePlugins brings the running device plugins of one kind in line
+// with the discovered resources, given with their namespace: plugins for
+// resources that are no longer present, or moved to another namespace, are
+// stopped, resources without a plugin, new or with one that failed to start,
+// get a new plugin and the remaining plugins push their updated device list to
+// kubelet. The caller must hold the lock guarding plugins.
+func reconcileDevicePlugins(plugins map[string]*GenericDevicePlugin, resources map[string]string, start func(deviceName string)) {
+	for deviceName, dp := range plugins {
+		if namespace, ok := resources[deviceName]; !ok || namespace != dp.namespace {
+			log.Printf("No %s devices left, stopping device plugin", dp.resourceName())
+			if err := dp.Stop(); err != nil {
+				log.Printf("Error stopping %s device plugin: %v", deviceName, err)
+			}
+			delete(plugins, deviceName)
+			continue
+		}
+		dp.refresh()
+	}
+
+	for deviceName := range resources {
+		if _, exists := plugins[deviceName]; exists {
+			continue
+		}
+		start(deviceName)
+	}
+}
@@ -0,0 +1,194 @@
+package device_plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// useDaemonPlugins gives the test a fresh rootCtx for the plugins the daemon
+// starts itself, and stops all of them when the test ends.
+func useDaemonPlugins(t *testing.T) {
+	rootCtx, rootCancel = context.WithCancel(context.Background())
+	stop := func(lock *sync.Mutex, plugins map[string]*GenericDevicePlugin) {
+		lock.Lock()
+		defer lock.Unlock()
+		for name, dp := range plugins {
+			dp.Stop()
+			delete(plugins, name)
+		}
+	}
+	t.Cleanup(func() {
+		stop(&pciPluginsLock, pciPlugins)
+		stop(&vgpuPluginsLock, vgpuPlugins)
+		rootCancel()
+	})
+}
+
+// daemonPlugin returns the running passthrough plugin of the resource, or nil.
+func daemonPlugin(deviceName string) *GenericDevicePlugin {
+	pciPluginsLock.Lock()
+	defer pciPluginsLock.Unlock()
+	return pciPlugins[deviceName]
+}
+
+func TestRefreshRetriesFailedStart(t *testing.T) {
+	newTestHost(t)
+	useDaemonPlugins(t)
+
+	// without the directory the plugin cannot listen on its socket
+	if err := os.RemoveAll(devicePluginPath); err != nil {
+		t.Fatal(err)
+	}
+	refreshPciDevicePlugins()
+	if daemonPlugin("1330") != nil {
+		t.Fatal("plugin for 1330 running without a socket")
+	}
+	if err := checkReady(); err == nil || !strings.Contains(err.Error(), "1330: device plugin is not running") {
+		t.Errorf("ready = %v, want 1330 not running", err)
+	}
+
+	// the inventory is the same, the next rescan starts it
+	if err := os.MkdirAll(devicePluginPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	kubelet := newFakeKubelet(t)
+	refreshPciDevicePlugins()
+	if req := kubelet.waitForRegistration(t); req.ResourceName != "xdxct.com/1330" {
+		t.Fatalf("registered %s, want xdxct.com/1330", req.ResourceName)
+	}
+	if daemonPlugin("1330") == nil {
+		t.Error("no plugin for 1330 after the retry")
+	}
+}
+
+// daemonVgpuPlugin returns the running vGPU plugin of the resource, or nil.
+func daemonVgpuPlugin(deviceName string) *GenericDevicePlugin {
+	vgpuPluginsLock.Lock()
+	defer vgpuPluginsLock.Unlock()
+	return vgpuPlugins[deviceName]
+}
+
+func TestRefreshPciDevicePlugins(t *testing.T) {
+	s := newTestHost(t)
+	kubelet := newFakeKubelet(t)
+	useDaemonPlugins(t)
+
+	refreshPciDevicePlugins()
+	if req := kubelet.waitForRegistration(t); req.ResourceName != "xdxct.com/1330" {
+		t.Fatalf("registered %s, want xdxct.com/1330", req.ResourceName)
+	}
+	dp := daemonPlugin("1330")
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	recvDevices(t, stream)
+
+	// a new model bound to vfio-pci gets its own plugin
+	s.addPciDevice(pciDevice{addr: "0000:d8:00.0", vendor: "1eed", device: "1340", class: "030000", driver: "vfio-pci", group: "11"})
+	refreshPciDevicePlugins()
+	if req := kubelet.waitForRegistration(t); req.ResourceName != "xdxct.com/1340" {
+		t.Fatalf("registered %s, want xdxct.com/1340", req.ResourceName)
+	}
+	newModel := daemonPlugin("1340")
+	if newModel == nil {
+		t.Fatal("no plugin for the new model")
+	}
+
+	// a new group of a known model reaches the open stream
+	s.addPciDevice(pciDevice{addr: "0000:d9:00.0", vendor: "1eed", device: "1330", class: "030000", driver: "vfio-pci", group: "12"})
+	refreshPciDevicePlugins()
+	want := map[string]string{"7": pluginapi.Healthy, "8": pluginapi.Healthy, "12": pluginapi.Healthy}
+	if got := recvDevices(t, stream); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListAndWatch = %v, want %v", got, want)
+	}
+
+	// a NUMA node moving is not an inventory change, but reaches kubelet
+	for _, addr := range []string{"0000:3b:00.0", "0000:3b:00.1"} {
+		s.writeFile(filepath.Join(s.devicePath(addr), "numa_node"), "1\n")
+	}
+	refreshPciDevicePlugins()
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dev := range resp.Devices {
+		if dev.ID == "7" && !reflect.DeepEqual(numaNodeIDs(dev), []int64{1}) {
+			t.Errorf("NUMA nodes of 7 = %v, want [1]", numaNodeIDs(dev))
+		}
+	}
+
+	// unbinding the last group of a model stops its plugin
+	if err := os.Remove(filepath.Join(s.devicePath("0000:d8:00.0"), "driver")); err != nil {
+		t.Fatal(err)
+	}
+	refreshPciDevicePlugins()
+	if dp := daemonPlugin("1340"); dp != nil {
+		t.Error("plugin for 1340 still running without devices")
+	}
+	if _, err := os.Stat(newModel.sockPath); !os.IsNotExist(err) {
+		t.Errorf("socket of the stopped plugin left behind: %v", err)
+	}
+	if daemonPlugin("1330") != dp {
+		t.Error("plugin for 1330 was replaced")
+	}
+}
+
+func TestWatchVgpus(t *testing.T) {
+	s := newTestHost(t)
+	kubelet := newFakeKubelet(t)
+	useDaemonPlugins(t)
+
+	refreshVgpuDevicePlugins()
+	if req := kubelet.waitForRegistration(t); req.ResourceName != "xdxct.com/XGV_V0_1G_1_CORE" {
+		t.Fatalf("registered %s, want xdxct.com/XGV_V0_1G_1_CORE", req.ResourceName)
+	}
+	dp := daemonVgpuPlugin("XGV_V0_1G_1_CORE")
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	recvDevices(t, stream)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchDevices(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// a vGPU created out of band reaches the open stream; until the watcher,
+	// which may not be watching yet, sees it the bus directory is touched
+	const created = "9d5c5a1e-1b4a-4e0a-8a3e-000000000003"
+	s.addMdev("0000:5e:00.0", "xgv-XGV_V0_1G_1_CORE", created, "23")
+	deadline := time.Now().Add(testTimeout)
+	for len(dp.deviceIDs()) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("created vGPU was not discovered")
+		}
+		s.writeFile(filepath.Join(vGpuBasePath, "touch"), "")
+		if err := os.Remove(filepath.Join(vGpuBasePath, "touch")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(3 * discoverySettleDelay / 2)
+	}
+	want := map[string]string{testVgpu1: pluginapi.Healthy, testVgpu2: pluginapi.Healthy, created: pluginapi.Healthy}
+	if got := recvDevices(t, stream); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListAndWatch = %v, want %v", got, want)
+	}
+
+	// removing the last vGPU of a type stops its plugin
+	for _, uuid := range []string{testVgpu1, testVgpu2, created} {
+		s.removeMdev("0000:5e:00.0", uuid)
+	}
+	refreshVgpuDevicePlugins()
+	if daemonVgpuPlugin("XGV_V0_1G_1_CORE") != nil {
+		t.Error("plugin for XGV_V0_1G_1_CORE still running without vGPUs")
+	}
+}
@@ -0,0 +1,260 @@
+package device_plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// Results of a doctor check, from best to worst.
+const (
+	DoctorPass = "pass"
+	DoctorWarn = "warn"
+	DoctorFail = "fail"
+)
+
+// modules every host needs for VFIO passthrough, and the one vGPUs need
+var (
+	vfioModules = []string{"vfio", "vfio_iommu_type1", "vfio_pci"}
+	mdevModule  = "mdev"
+)
+
+// doctorCheck is the outcome of one host prerequisite check. Hint tells how to
+// fix a failed or warned check.
+type doctorCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+func pass(name string, format string, args ...interface{}) doctorCheck {
+	return doctorCheck{Name: name, Status: DoctorPass, Message: fmt.Sprintf(format, args...)}
+}
+
+func warn(name string, hint string, format string, args ...interface{}) doctorCheck {
+	return doctorCheck{Name: name, Status: DoctorWarn, Message: fmt.Sprintf(format, args...), Hint: hint}
+}
+
+func fail(name string, hint string, format string, args ...interface{}) doctorCheck {
+	return doctorCheck{Name: name, Status: DoctorFail, Message: fmt.Sprintf(format, args...), Hint: hint}
+}
+
+// RunDoctor checks the host prerequisites of the device plugin, writes the
+// result as a table or as JSON and returns the worst status of all checks.
+func RunDoctor(w io.Writer, format string) (string, error) {
+	if format != OutputTable && format != OutputJSON {
+		return "", fmt.Errorf("unknown output format %q, want %s or %s", format, OutputTable, OutputJSON)
+	}
+	checks, err := doctorChecks()
+	if err != nil {
+		return "", err
+	}
+
+	worst := DoctorPass
+	counts := make(map[string]int)
+	for _, check := range checks {
+		counts[check.Status]++
+		if check.Status == DoctorFail || (check.Status == DoctorWarn && worst == DoctorPass) {
+			worst = check.Status
+		}
+	}
+	if format == OutputJSON {
+		return worst, writeJSON(w, checks)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tCHECK\tMESSAGE")
+	for _, check := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Status, check.Name, check.Message)
+		if check.Hint != "" {
+			fmt.Fprintf(tw, "\t\thint: %s\n", check.Hint)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed\n", counts[DoctorPass], counts[DoctorWarn], counts[DoctorFail])
+	return worst, nil
+}
+
+// doctorChecks runs every check in the order they build on each other: the
+// IOMMU, the kernel modules and drivers, the VFIO nodes and the devices.
+func doctorChecks() ([]doctorCheck, error) {
+	inv := discoverInventory()
+	gpus, err := inv.gpus()
+	if err != nil {
+		return nil, err
+	}
+	cfg := getConfig()
+
+	var checks []doctorCheck
+	groups, _ := os.ReadDir(iommuGroupBasePath)
+	checks = append(checks, checkKernelCmdline(len(groups) > 0))
+	if len(groups) > 0 {
+		checks = append(checks, pass("iommu groups", "%d IOMMU groups in %s", len(groups), iommuGroupBasePath))
+	} else {
+		checks = append(checks, fail("iommu groups", "enable VT-d or AMD-Vi in the firmware and the IOMMU on the kernel command line",
+			"no IOMMU groups in %s, the IOMMU is disabled", iommuGroupBasePath))
+	}
+
+	needMdev := len(cfg.MdevLayout) > 0
+	for _, gpu := range gpus {
+		if len(gpu.Mdevs) > 0 || supportsMdev(gpu.Address) {
+			needMdev = true
+		}
+	}
+	modules := append([]string(nil), vfioModules...)
+	if needMdev {
+		modules = append(modules, mdevModule)
+	}
+	for _, module := range modules {
+		name := "module " + module
+		if _, err := os.Stat(filepath.Join(cfg.Paths.KernelModules, module)); err != nil {
+			checks = append(checks, fail(name, "modprobe "+module, "%s is not loaded", module))
+		} else {
+			checks = append(checks, pass(name, "%s is loaded", module))
+		}
+	}
+	for _, driver := range cfg.pciDrivers() {
+		name := "driver " + driver
+		if _, err := os.Stat(pciDriverPath(driver)); err != nil {
+			checks = append(checks, fail(name, "modprobe "+strings.ReplaceAll(driver, "-", "_"),
+				"passthrough driver %s is not registered in %s", driver, cfg.Paths.PciDrivers))
+		} else {
+			checks = append(checks, pass(name, "passthrough driver %s is registered", driver))
+		}
+	}
+
+	checks = append(checks, checkVfioNode("vfio", "the VFIO container"))
+	advertised := make(map[string]bool)
+	for _, gpu := range gpus {
+		if gpu.Resource != "" && !advertised[gpu.IommuGroup] {
+			advertised[gpu.IommuGroup] = true
+			checks = append(checks, checkVfioNode(gpu.IommuGroup, fmt.Sprintf("IOMMU group %s of %s", gpu.IommuGroup, gpu.Address)))
+		}
+	}
+
+	if len(gpus) == 0 {
+		checks = append(checks, warn("devices", "check the selectors in the configuration and lspci -nn",
+			"no PCI device matches the configured selectors"))
+	}
+	for _, gpu := range gpus {
+		checks = append(checks, checkGpu(gpu))
+	}
+	for _, parent := range sortedLayoutParents(cfg.MdevLayout) {
+		if _, err := os.Stat(filepath.Join(basePciPath, parent)); err != nil {
+			checks = append(checks, fail("device "+parent, "fix the PCI address in mdevLayout",
+				"vGPU parent %s from mdevLayout does not exist", parent))
+		}
+	}
+	return checks, nil
+}
+
+// checkKernelCmdline looks for the IOMMU options on the kernel command line.
+// Without them the IOMMU may still be on by default, which the IOMMU groups
+// tell.
+func checkKernelCmdline(haveGroups bool) doctorCheck {
+	const name = "kernel cmdline"
+	path := getConfig().Paths.KernelCmdline
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return warn(name, "", "unable to read %s: %v", path, err)
+	}
+	var enabled []string
+	for _, option := range strings.Fields(string(data)) {
+		switch option {
+		case "intel_iommu=off", "amd_iommu=off", "iommu=off":
+			return fail(name, "remove "+option+" from the kernel command line", "the IOMMU is disabled with %s", option)
+		case "intel_iommu=on", "amd_iommu=on", "iommu=pt":
+			enabled = append(enabled, option)
+		}
+	}
+	switch {
+	case len(enabled) > 0:
+		return pass(name, "IOMMU enabled with %s", strings.Join(enabled, " "))
+	case haveGroups:
+		return pass(name, "IOMMU enabled by the kernel default")
+	default:
+		return fail(name, "add intel_iommu=on (Intel) or amd_iommu=on (AMD) and iommu=pt to the kernel command line",
+			"neither intel_iommu=on nor amd_iommu=on is set")
+	}
+}
+
+func checkVfioNode(group string, what string) doctorCheck {
+	path := filepath.Join(vfioGroupPath, group)
+	name := path
+	if _, err := os.Stat(path); err != nil {
+		return fail(name, "load vfio-pci and bind the device to it, and mount /dev/vfio into the plugin container",
+			"%s is missing, the node of %s", path, what)
+	}
+	return pass(name, "node of %s present", what)
+}
+
+// checkGpu tells whether the selected function is usable for passthrough or as
+// a vGPU parent.
+func checkGpu(gpu gpuInfo) doctorCheck {
+	name := "device " + gpu.Address
+	bindHint := fmt.Sprintf("bind it with: xdxct-kubevirt-device-plugin bind -d %s", gpu.Address)
+	inLayout := getConfig().MdevLayout[gpu.Address] != nil
+
+	switch {
+	case gpu.Resource != "":
+		if blockers := groupBlockers(gpu.Address); len(blockers) > 0 {
+			return fail(name, bindHint, "IOMMU group %s also holds %s, which vfio requires to be bound to vfio as well",
+				gpu.IommuGroup, strings.Join(blockers, ", "))
+		}
+		return pass(name, "advertised as %s (IOMMU group %s)", gpu.Resource, gpu.IommuGroup)
+	case len(gpu.Mdevs) > 0 || supportsMdev(gpu.Address):
+		return pass(name, "vGPU parent bound to %s with %d vGPUs", gpu.Driver, len(gpu.Mdevs))
+	case inLayout:
+		return fail(name, "load the vendor host driver for vGPUs",
+			"listed in mdevLayout but does not support vGPUs, bound to %s", orDash(gpu.Driver))
+	case gpu.Driver == "":
+		return warn(name, bindHint+", or load the vendor host driver for vGPUs", "not bound to any driver")
+	default:
+		if match, ok := selectPciDevice(gpu.Address); ok && match.driver == gpu.Driver && gpu.IommuGroup == "" {
+			return fail(name, "enable the IOMMU", "bound to %s but not in an IOMMU group", gpu.Driver)
+		}
+		return warn(name, bindHint, "bound to %s, neither advertised for passthrough nor carrying vGPUs", gpu.Driver)
+	}
+}
+
+// groupBlockers returns the functions in the IOMMU group of addr that keep
+// vfio from handing out the group: endpoints bound to a driver other than a
+// passthrough driver.
+func groupBlockers(addr string) []string {
+	members, err := iommuGroupDevices(addr)
+	if err != nil {
+		return nil
+	}
+	drivers := make(map[string]bool)
+	for _, driver := range getConfig().pciDrivers() {
+		drivers[driver] = true
+	}
+	var blockers []string
+	for _, member := range members {
+		driver := currentPciDriver(member)
+		if driver == "" || drivers[driver] || isPciBridge(member) {
+			continue
+		}
+		blockers = append(blockers, fmt.Sprintf("%s (%s)", member, driver))
+	}
+	return blockers
+}
+
+func supportsMdev(addr string) bool {
+	_, err := os.Stat(filepath.Join(basePciPath, addr, "mdev_supported_types"))
+	return err == nil
+}
+
+func sortedLayoutParents(layout map[string]map[string]int) []string {
+	parents := make(map[string]string, len(layout))
+	for parent := range layout {
+		parents[parent] = parent
+	}
+	return sortedKeys(parents)
+}
@@ -0,0 +1,128 @@
+package device_plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newDoctorHost makes newTestHost pass every doctor check: the IOMMU is on,
+// the VFIO and mdev modules are loaded and the VFIO container node exists.
+func newDoctorHost(t *testing.T) *fakeSysfs {
+	s := newTestHost(t)
+	s.writeFile(s.cfg.Paths.KernelCmdline, "BOOT_IMAGE=/vmlinuz root=/dev/sda1 intel_iommu=on iommu=pt\n")
+	for _, module := range append(vfioModules, mdevModule) {
+		s.mkdir(filepath.Join(s.cfg.Paths.KernelModules, module))
+	}
+	s.writeFile(filepath.Join(s.cfg.Paths.VfioDevices, "vfio"), "")
+	return s
+}
+
+// runDoctor returns the worst status and the status of every check by name.
+func runDoctor(t *testing.T) (string, map[string]doctorCheck) {
+	t.Helper()
+	var out bytes.Buffer
+	worst, err := RunDoctor(&out, OutputJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checks []doctorCheck
+	if err := json.Unmarshal(out.Bytes(), &checks); err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]doctorCheck)
+	for _, check := range checks {
+		byName[check.Name] = check
+	}
+	return worst, byName
+}
+
+func TestDoctorHealthyHost(t *testing.T) {
+	s := newDoctorHost(t)
+
+	worst, checks := runDoctor(t)
+	for name, check := range checks {
+		if check.Status != DoctorPass {
+			t.Errorf("%s: %s %s", name, check.Status, check.Message)
+		}
+	}
+	if worst != DoctorPass {
+		t.Errorf("worst = %s, want %s", worst, DoctorPass)
+	}
+	for _, name := range []string{
+		"kernel cmdline",
+		"iommu groups",
+		"module vfio_pci",
+		"module mdev",
+		"driver vfio-pci",
+		filepath.Join(s.cfg.Paths.VfioDevices, "vfio"),
+		filepath.Join(s.cfg.Paths.VfioDevices, "8"),
+		"device 0000:3b:00.1",
+		"device 0000:5e:00.0",
+	} {
+		if _, ok := checks[name]; !ok {
+			t.Errorf("check %q missing", name)
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := RunDoctor(&out, OutputTable); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "STATUS") || !strings.HasSuffix(out.String(), "0 warnings, 0 failed\n") {
+		t.Errorf("table =\n%s", out.String())
+	}
+}
+
+func TestDoctorBrokenHost(t *testing.T) {
+	s := newDoctorHost(t)
+	s.writeFile(s.cfg.Paths.KernelCmdline, "root=/dev/sda1 intel_iommu=off\n")
+	if err := os.Remove(filepath.Join(s.cfg.Paths.KernelModules, "vfio_iommu_type1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(s.cfg.Paths.VfioDevices, "8")); err != nil {
+		t.Fatal(err)
+	}
+	// a NIC in the IOMMU group of a passthrough GPU keeps vfio from using it
+	s.addPciDevice(pciDevice{addr: "0000:3b:00.2", vendor: "8086", device: "1533", class: "020000", driver: "igb", group: "7"})
+	s.addPciDevice(pciDevice{addr: "0000:d8:00.0", vendor: "1eed", device: "1330", class: "030000", group: "50"})
+
+	worst, checks := runDoctor(t)
+	if worst != DoctorFail {
+		t.Errorf("worst = %s, want %s", worst, DoctorFail)
+	}
+	for name, want := range map[string]string{
+		"kernel cmdline":                            DoctorFail,
+		"module vfio_iommu_type1":                   DoctorFail,
+		"module vfio_pci":                           DoctorPass,
+		filepath.Join(s.cfg.Paths.VfioDevices, "8"): DoctorFail,
+		"device 0000:3b:00.0":                       DoctorFail,
+		"device 0000:3c:00.0":                       DoctorPass,
+		"device 0000:d8:00.0":                       DoctorWarn,
+	} {
+		if got := checks[name]; got.Status != want {
+			t.Errorf("%s = %s %q, want %s", name, got.Status, got.Message, want)
+		}
+	}
+	if hint := checks["device 0000:d8:00.0"].Hint; !strings.Contains(hint, "bind -d 0000:d8:00.0") {
+		t.Errorf("hint = %q", hint)
+	}
+	if msg := checks["device 0000:3b:00.0"].Message; !strings.Contains(msg, "0000:3b:00.2 (igb)") {
+		t.Errorf("message = %q", msg)
+	}
+}
+
+func TestDoctorKernelCmdlineDefault(t *testing.T) {
+	s := newDoctorHost(t)
+	s.writeFile(s.cfg.Paths.KernelCmdline, "root=/dev/sda1\n")
+
+	if check := checkKernelCmdline(true); check.Status != DoctorPass {
+		t.Errorf("with IOMMU groups: %+v", check)
+	}
+	if check := checkKernelCmdline(false); check.Status != DoctorFail || check.Hint == "" {
+		t.Errorf("without IOMMU groups: %+v", check)
+	}
+}
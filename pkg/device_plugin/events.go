@@ -0,0 +1,224 @@
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// Event reasons
+const (
+	eventGpuUnhealthy       = "GPUUnhealthy"
+	eventGpuRecovered       = "GPURecovered"
+	eventAllocationRejected = "AllocationRejected"
+)
+
+// eventComponent is the source of the events the plugin records.
+const eventComponent = "xdxct-kubevirt-device-plugin"
+
+var (
+	// an event identical to one recorded within this interval is dropped
+	eventDedupInterval = 5 * time.Minute
+	// events beyond the burst are dropped, the bucket refills at eventQPS
+	eventQPS   float32 = 0.2
+	eventBurst         = 25
+	// health changes beyond this many waiting to be recorded are dropped
+	healthEventQueueSize = 100
+)
+
+// deviceEvents records the events of the daemon, nil if disabled.
+var deviceEvents *eventRecorder
+
+// eventRecorder records events on the node, and for device health also on the
+// pods the device is assigned to. Identical events are recorded once per
+// eventDedupInterval and all events share a token bucket, so a flapping
+// device cannot flood the API server. Health changes are queued and recorded
+// by run, as looking up the pods asks kubelet and the API server.
+type eventRecorder struct {
+	recorder record.EventRecorder
+	node     *corev1.ObjectReference
+	// podsOf returns the pods the device of the resource is assigned to
+	podsOf func(resourceName string, id string) []runtime.Object
+	health chan healthEvent
+
+	lock    sync.Mutex
+	limiter flowcontrol.RateLimiter
+	sent    map[string]time.Time // key: object, reason and message value: when it was last recorded
+}
+
+func newEventRecorder(recorder record.EventRecorder, nodeName string, podsOf func(resourceName string, id string) []runtime.Object) *eventRecorder {
+	return &eventRecorder{
+		recorder: recorder,
+		// kubelet records node events with the node name as UID, which is
+		// what kubectl describe node looks for.
+		node:    &corev1.ObjectReference{Kind: "Node", Name: nodeName, UID: types.UID(nodeName)},
+		podsOf:  podsOf,
+		health:  make(chan healthEvent, healthEventQueueSize),
+		limiter: flowcontrol.NewTokenBucketRateLimiter(eventQPS, eventBurst),
+		sent:    make(map[string]time.Time),
+	}
+}
+
+// startEventRecorder makes deviceEvents record to the API server until rootCtx
+// is canceled.
+func startEventRecorder(client kubernetes.Interface, nodeName string) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent, Host: nodeName})
+	events := newEventRecorder(recorder, nodeName, func(resourceName string, id string) []runtime.Object {
+		return podsWithDevice(client, resourceName, id)
+	})
+	deviceEvents = events
+	goBackground(func() {
+		events.run(rootCtx.Done())
+		broadcaster.Shutdown()
+	})
+	log.Printf("Recording events for node %s", nodeName)
+}
+
+// healthEvent is a device health change waiting to be recorded.
+type healthEvent struct {
+	resourceName string
+	id           string
+	health       string
+	cause        string
+}
+
+// deviceHealthChanged queues GPUUnhealthy or GPURecovered for a device of the
+// resource. It never blocks the health checks: the change is dropped if the
+// queue is full.
+func (r *eventRecorder) deviceHealthChanged(resourceName string, id string, health string, cause string) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.health <- healthEvent{resourceName: resourceName, id: id, health: health, cause: cause}:
+	default:
+		log.Printf("Dropping health event of %s %s, too many events waiting", resourceName, id)
+	}
+}
+
+// run records the queued health changes until stop is closed.
+func (r *eventRecorder) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-r.health:
+			r.recordHealth(event)
+		}
+	}
+}
+
+func (r *eventRecorder) recordHealth(event healthEvent) {
+	eventtype, reason := corev1.EventTypeNormal, eventGpuRecovered
+	message := fmt.Sprintf("Device %s of %s is healthy again", event.id, event.resourceName)
+	if event.health != pluginapi.Healthy {
+		eventtype, reason = corev1.EventTypeWarning, eventGpuUnhealthy
+		message = fmt.Sprintf("Device %s of %s is unhealthy: %s", event.id, event.resourceName, event.cause)
+	}
+	r.record(r.node, eventtype, reason, message)
+	for _, pod := range r.podsOf(event.resourceName, event.id) {
+		r.record(pod, eventtype, reason, message)
+	}
+}
+
+// allocationRejected records AllocationRejected on the node. kubelet does not
+// tell the plugin which pod the allocation is for.
+func (r *eventRecorder) allocationRejected(resourceName string, cause string) {
+	if r == nil {
+		return
+	}
+	r.record(r.node, corev1.EventTypeWarning, eventAllocationRejected, fmt.Sprintf("Rejected allocation of %s: %s", resourceName, cause))
+}
+
+func (r *eventRecorder) record(object runtime.Object, eventtype string, reason string, message string) {
+	key := fmt.Sprintf("%s/%s/%s", objectKey(object), reason, message)
+	now := time.Now()
+
+	r.lock.Lock()
+	for k, sent := range r.sent {
+		if now.Sub(sent) >= eventDedupInterval {
+			delete(r.sent, k)
+		}
+	}
+	if _, ok := r.sent[key]; ok {
+		r.lock.Unlock()
+		return
+	}
+	if !r.limiter.TryAccept() {
+		r.lock.Unlock()
+		log.Printf("Dropping %s event, too many events: %s", reason, message)
+		return
+	}
+	r.sent[key] = now
+	r.lock.Unlock()
+
+	r.recorder.Event(object, eventtype, reason, message)
+}
+
+func objectKey(object runtime.Object) string {
+	if ref, ok := object.(*corev1.ObjectReference); ok {
+		return fmt.Sprintf("%s/%s/%s", ref.Kind, ref.Namespace, ref.Name)
+	}
+	if obj, ok := object.(metav1.Object); ok {
+		return fmt.Sprintf("%T/%s/%s", object, obj.GetNamespace(), obj.GetName())
+	}
+	return fmt.Sprintf("%T", object)
+}
+
+// podsWithDevice returns the pods kubelet assigned the device of the resource
+// to. Pods that cannot be read from the API server are referenced by name.
+func podsWithDevice(client kubernetes.Interface, resourceName string, id string) []runtime.Object {
+	resp, err := listPodResources()
+	if err != nil {
+		log.Printf("Unable to get the pods using %s %s from kubelet: %v", resourceName, id, err)
+		return nil
+	}
+	var pods []runtime.Object
+	for _, pod := range resp.PodResources {
+		if !podHasDevice(pod.Containers, resourceName, id) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), podResourcesTimeout)
+		obj, err := client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		cancel()
+		if err != nil {
+			log.Printf("Unable to get pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			pods = append(pods, &corev1.ObjectReference{Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name})
+			continue
+		}
+		pods = append(pods, obj)
+	}
+	return pods
+}
+
+func podHasDevice(containers []*podresourcesapi.ContainerResources, resourceName string, id string) bool {
+	for _, container := range containers {
+		for _, dev := range container.Devices {
+			if dev.ResourceName != resourceName {
+				continue
+			}
+			for _, devID := range dev.DeviceIds {
+				if devID == id {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package device_plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// useFakeEvents makes the daemon record its events to a fake recorder for the
+// test. The device 7 of xdxct.com/1330 is assigned to the pod vms/vm1.
+func useFakeEvents(t *testing.T) *record.FakeRecorder {
+	recorder := record.NewFakeRecorder(100)
+	recorder.IncludeObject = true
+	runEventRecorder(t, newEventRecorder(recorder, "node1", func(resourceName string, id string) []runtime.Object {
+		if resourceName == "xdxct.com/1330" && id == "7" {
+			return []runtime.Object{&corev1.ObjectReference{Kind: "Pod", Namespace: "vms", Name: "vm1"}}
+		}
+		return nil
+	}))
+	return recorder
+}
+
+// runEventRecorder makes r the recorder of the daemon and records its queued
+// health changes until the test ends.
+func runEventRecorder(t *testing.T, r *eventRecorder) {
+	deviceEvents = r
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.run(stop)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+		deviceEvents = nil
+	})
+}
+
+// recordedEvents returns the events recorded so far.
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func waitForEvent(t *testing.T, recorder *record.FakeRecorder) string {
+	t.Helper()
+	select {
+	case event := <-recorder.Events:
+		return event
+	case <-time.After(testTimeout):
+		t.Fatal("no event recorded")
+		return ""
+	}
+}
+
+func TestEventRecorderDedupAndRateLimit(t *testing.T) {
+	defer func(burst int) { eventBurst = burst }(eventBurst)
+	eventBurst = 3
+	recorder := useFakeEvents(t)
+
+	gone := healthEvent{resourceName: "xdxct.com/1330", id: "7", health: pluginapi.Unhealthy, cause: "gone"}
+	deviceEvents.recordHealth(gone)
+	deviceEvents.recordHealth(gone)
+	want := []string{
+		"Warning GPUUnhealthy Device 7 of xdxct.com/1330 is unhealthy: gone involvedObject{kind=Node,apiVersion=}",
+		"Warning GPUUnhealthy Device 7 of xdxct.com/1330 is unhealthy: gone involvedObject{kind=Pod,apiVersion=}",
+	}
+	if got := recordedEvents(recorder); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+
+	// one token is left in the bucket
+	deviceEvents.allocationRejected("xdxct.com/1330", "first")
+	deviceEvents.allocationRejected("xdxct.com/1330", "second")
+	want = []string{"Warning AllocationRejected Rejected allocation of xdxct.com/1330: first involvedObject{kind=Node,apiVersion=}"}
+	if got := recordedEvents(recorder); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestPciHealthEvents(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+	recorder := useFakeEvents(t)
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	waitForReady(t, dp)
+
+	if err := os.RemoveAll(filepath.Join(iommuGroupBasePath, "7")); err != nil {
+		t.Fatal(err)
+	}
+	const message = "Device 7 of xdxct.com/1330 is unhealthy: IOMMU group 7 was removed"
+	want := []string{
+		"Warning GPUUnhealthy " + message + " involvedObject{kind=Node,apiVersion=}",
+		"Warning GPUUnhealthy " + message + " involvedObject{kind=Pod,apiVersion=}",
+	}
+	if got := []string{waitForEvent(t, recorder), waitForEvent(t, recorder)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestHealthEventsDoNotBlock(t *testing.T) {
+	newTestHost(t)
+	release := newSlowPodResources(t, &podresourcesapi.PodResources{
+		Name:      "virt-launcher-vm1",
+		Namespace: "vms",
+		Containers: []*podresourcesapi.ContainerResources{{
+			Name:    "compute",
+			Devices: []*podresourcesapi.ContainerDevices{{ResourceName: "xdxct.com/1330", DeviceIds: []string{"7"}}},
+		}},
+	})
+	client := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "vms", Name: "virt-launcher-vm1"}})
+	recorder := record.NewFakeRecorder(100)
+	recorder.IncludeObject = true
+	runEventRecorder(t, newEventRecorder(recorder, "node1", func(resourceName string, id string) []runtime.Object {
+		return podsWithDevice(client, resourceName, id)
+	}))
+	createIommuDeviceMap()
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+
+	// kubelet holds the first change, the queue fills up and the rest is dropped
+	start := time.Now()
+	for i := 0; i < 2*healthEventQueueSize; i++ {
+		health := pluginapi.Unhealthy
+		if i%2 == 1 {
+			health = pluginapi.Healthy
+		}
+		dp.reportHealth("7", health, "gone")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("reporting health took %v while kubelet did not answer", elapsed)
+	}
+	if got := dp.state.health("7"); got != pluginapi.Healthy {
+		t.Errorf("health = %s, want the last reported %s", got, pluginapi.Healthy)
+	}
+
+	close(release)
+	want := "Warning GPUUnhealthy Device 7 of xdxct.com/1330 is unhealthy: gone involvedObject{kind=Node,apiVersion=}"
+	if got := waitForEvent(t, recorder); got != want {
+		t.Errorf("event = %q, want %q", got, want)
+	}
+	if got := waitForEvent(t, recorder); !strings.HasPrefix(got, "Warning GPUUnhealthy") {
+		t.Errorf("event = %q, want GPUUnhealthy on the pod", got)
+	}
+}
+
+func TestAllocationRejectedEvent(t *testing.T) {
+	s := newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+	recorder := useFakeEvents(t)
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	s.moveToIommuGroup("0000:3c:00.0", "9")
+
+	_, err := dialDevicePlugin(t, dp).Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"8"}}},
+	})
+	if err == nil {
+		t.Fatal("Allocate succeeded for a moved IOMMU group")
+	}
+	want := "Warning AllocationRejected Rejected allocation of xdxct.com/1330: invalid allocation request: unknown device: 0000:3c:00.0 involvedObject{kind=Node,apiVersion=}"
+	if got := waitForEvent(t, recorder); got != want {
+		t.Errorf("event = %q, want %q", got, want)
+	}
+}
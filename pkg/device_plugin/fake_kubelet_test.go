@@ -0,0 +1,141 @@
+package device_plugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const testTimeout = 10 * time.Second
+
+// fakeKubelet serves the kubelet Registration service on kubeletSocket and
+// records every registration it receives.
+type fakeKubelet struct {
+	server   *grpc.Server
+	requests chan *pluginapi.RegisterRequest
+}
+
+func newFakeKubelet(t *testing.T) *fakeKubelet {
+	t.Helper()
+	sock, err := net.Listen("unix", kubeletSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &fakeKubelet{
+		server:   grpc.NewServer(),
+		requests: make(chan *pluginapi.RegisterRequest, 16),
+	}
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	go k.server.Serve(sock)
+	t.Cleanup(k.server.Stop)
+	return k
+}
+
+func (k *fakeKubelet) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.requests <- req
+	return &pluginapi.Empty{}, nil
+}
+
+func (k *fakeKubelet) waitForRegistration(t *testing.T) *pluginapi.RegisterRequest {
+	t.Helper()
+	select {
+	case req := <-k.requests:
+		return req
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for device plugin registration")
+		return nil
+	}
+}
+
+// setDuration overrides a tunable for the test. It is restored only after the
+// cleanups registered later, such as stopping plugins, have run.
+func setDuration(t *testing.T, v *time.Duration, d time.Duration) {
+	old := *v
+	*v = d
+	t.Cleanup(func() { *v = old })
+}
+
+// startTestPlugin starts dp the way the daemon does and stops it when the test
+// ends. It returns the cancel function of the context dp runs under, which
+// plays the part of Shutdown.
+func startTestPlugin(t *testing.T, dp *GenericDevicePlugin) context.CancelFunc {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := dp.Start(ctx); err != nil {
+		cancel()
+		t.Fatalf("failed to start %s device plugin: %v", dp.deviceName, err)
+	}
+	t.Cleanup(func() {
+		dp.Stop()
+		cancel()
+	})
+	return cancel
+}
+
+// waitForReady waits until dp is serving and registered with kubelet.
+func waitForReady(t *testing.T, dp *GenericDevicePlugin) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for dp.ready() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s device plugin did not become ready: %v", dp.deviceName, dp.ready())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dialDevicePlugin connects to the plugin like kubelet does after registration.
+func dialDevicePlugin(t *testing.T, dp *GenericDevicePlugin) pluginapi.DevicePluginClient {
+	t.Helper()
+	conn, err := connect(dp.sockPath, connectTimeOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pluginapi.NewDevicePluginClient(conn)
+}
+
+// listAndWatch opens a ListAndWatch stream that is closed when the test ends.
+func listAndWatch(t *testing.T, client pluginapi.DevicePluginClient) pluginapi.DevicePlugin_ListAndWatchClient {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+// recvDevices waits for the next device list on the stream and returns the
+// health of every device by ID.
+func recvDevices(t *testing.T, stream pluginapi.DevicePlugin_ListAndWatchClient) map[string]string {
+	t.Helper()
+	type result struct {
+		resp *pluginapi.ListAndWatchResponse
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := stream.Recv()
+		ch <- result{resp, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("ListAndWatch failed: %v", r.err)
+		}
+		devices := make(map[string]string)
+		for _, dev := range r.resp.Devices {
+			devices[dev.ID] = dev.Health
+		}
+		return devices
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for ListAndWatch")
+		return nil
+	}
+}
@@ -0,0 +1,282 @@
+package device_plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSysfs is a synthetic sysfs tree in a temporary directory, laid out like
+// the real one: the bus directories hold symlinks into /sys/devices, and the
+// driver, iommu_group and mdev_type links point where the kernel points them.
+// newFakeSysfs points the package configuration at it for the test.
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+	cfg  *Config
+
+	upstream  map[string]string // key: pci address value: upstream path set by addPciDevice
+	lock      sync.Mutex
+	writes    []string // every sysfs write, as "<path below root>=<value>"
+	nextGroup int      // IOMMU group of the next mdev created through sysfs
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	t.Helper()
+	root := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.HTTPAddress = ""
+	cfg.Paths = Paths{
+		PciDevices:    filepath.Join(root, "sys/bus/pci/devices"),
+		PciDrivers:    filepath.Join(root, "sys/bus/pci/drivers"),
+		MdevDevices:   filepath.Join(root, "sys/bus/mdev/devices"),
+		IommuGroups:   filepath.Join(root, "sys/kernel/iommu_groups"),
+		DevicePlugins: filepath.Join(root, "device-plugins"),
+		PodResources:  filepath.Join(root, "pod-resources"),
+		VfioDevices:   filepath.Join(root, "dev/vfio"),
+		CdiSpecs:      filepath.Join(root, "cdi"),
+		KernelCmdline: filepath.Join(root, "proc/cmdline"),
+		KernelModules: filepath.Join(root, "sys/module"),
+	}
+	s := &fakeSysfs{t: t, root: root, cfg: cfg, upstream: make(map[string]string), nextGroup: 100}
+	for _, dir := range []string{
+		cfg.Paths.PciDevices,
+		filepath.Join(cfg.Paths.PciDrivers, cfg.Driver),
+		cfg.Paths.MdevDevices,
+		cfg.Paths.IommuGroups,
+		cfg.Paths.DevicePlugins,
+		cfg.Paths.PodResources,
+		cfg.Paths.VfioDevices,
+	} {
+		s.mkdir(dir)
+	}
+	s.writeFile(filepath.Join(root, "sys/bus/pci/drivers_probe"), "")
+
+	SetConfig(cfg)
+	writeSysfs = s.applyWrite
+	t.Cleanup(func() {
+		writeSysfs = writeSysfsFunc
+		SetConfig(DefaultConfig())
+		iommuMap, deviceMap, vGpuMap, gpuVgpuMap = nil, nil, nil, nil
+	})
+	return s
+}
+
+// pciDevice describes a PCI function to create in the fake sysfs.
+type pciDevice struct {
+	addr   string
+	vendor string
+	device string
+	class  string
+	driver string // empty if unbound
+	group  string
+	numa   int
+
+	subsystemVendor string // optional
+	subsystemDevice string // optional
+	// the root bus and bridges above the function, e.g.
+	// "pci0000:3a/0000:3a:00.0", defaults to "pci0000:00"
+	upstream string
+}
+
+func (s *fakeSysfs) devicePath(addr string) string {
+	upstream, ok := s.upstream[addr]
+	if !ok {
+		upstream = "pci0000:00"
+	}
+	return filepath.Join(s.root, "sys/devices", upstream, addr)
+}
+
+func (s *fakeSysfs) addPciDevice(dev pciDevice) {
+	s.t.Helper()
+	if dev.upstream != "" {
+		s.upstream[dev.addr] = dev.upstream
+	}
+	dir := s.devicePath(dev.addr)
+	s.mkdir(dir)
+	s.writeFile(filepath.Join(dir, "vendor"), "0x"+dev.vendor+"\n")
+	s.writeFile(filepath.Join(dir, "device"), "0x"+dev.device+"\n")
+	s.writeFile(filepath.Join(dir, "class"), "0x"+dev.class+"\n")
+	s.writeFile(filepath.Join(dir, "numa_node"), fmt.Sprintf("%d\n", dev.numa))
+	if dev.subsystemVendor != "" {
+		s.writeFile(filepath.Join(dir, "subsystem_vendor"), "0x"+dev.subsystemVendor+"\n")
+	}
+	if dev.subsystemDevice != "" {
+		s.writeFile(filepath.Join(dir, "subsystem_device"), "0x"+dev.subsystemDevice+"\n")
+	}
+	s.writeFile(filepath.Join(dir, "driver_override"), "(null)\n")
+	s.symlink(dir, filepath.Join(s.cfg.Paths.PciDevices, dev.addr))
+
+	groupDir := filepath.Join(s.cfg.Paths.IommuGroups, dev.group)
+	s.mkdir(filepath.Join(groupDir, "devices"))
+	s.symlink(dir, filepath.Join(groupDir, "devices", dev.addr))
+	s.symlink(groupDir, filepath.Join(dir, "iommu_group"))
+	s.writeFile(filepath.Join(s.cfg.Paths.VfioDevices, dev.group), "")
+
+	if dev.driver != "" {
+		s.bind(dev.addr, dev.driver)
+	}
+}
+
+// bind points the driver link of the function at the given driver.
+func (s *fakeSysfs) bind(addr string, driver string) {
+	s.t.Helper()
+	driverDir := filepath.Join(s.cfg.Paths.PciDrivers, driver)
+	s.mkdir(driverDir)
+	link := filepath.Join(s.devicePath(addr), "driver")
+	os.Remove(link)
+	s.symlink(driverDir, link)
+}
+
+// moveToIommuGroup points the iommu_group link of the function at another group.
+func (s *fakeSysfs) moveToIommuGroup(addr string, group string) {
+	s.t.Helper()
+	groupDir := filepath.Join(s.cfg.Paths.IommuGroups, group)
+	s.mkdir(filepath.Join(groupDir, "devices"))
+	link := filepath.Join(s.devicePath(addr), "iommu_group")
+	os.Remove(link)
+	s.symlink(groupDir, link)
+}
+
+// addMdevType makes the parent GPU support the vGPU type.
+func (s *fakeSysfs) addMdevType(parent string, typeDir string, name string, available int) {
+	s.t.Helper()
+	dir := filepath.Join(s.devicePath(parent), "mdev_supported_types", typeDir)
+	s.mkdir(filepath.Join(dir, "devices"))
+	s.writeFile(filepath.Join(dir, "name"), "Type Name: "+name+"\n")
+	s.writeFile(filepath.Join(dir, "available_instances"), fmt.Sprintf("%d\n", available))
+	s.writeFile(filepath.Join(dir, "create"), "")
+}
+
+// addMdev creates a vGPU of a type previously added with addMdevType in its
+// own IOMMU group.
+func (s *fakeSysfs) addMdev(parent string, typeDir string, uuid string, group string) {
+	s.t.Helper()
+	groupDir := filepath.Join(s.cfg.Paths.IommuGroups, group)
+	typePath := filepath.Join(s.devicePath(parent), "mdev_supported_types", typeDir)
+	dir := filepath.Join(s.devicePath(parent), uuid)
+	s.mkdir(dir)
+	s.writeFile(filepath.Join(dir, "remove"), "")
+	s.symlink(typePath, filepath.Join(dir, "mdev_type"))
+	s.mkdir(filepath.Join(groupDir, "devices"))
+	s.symlink(groupDir, filepath.Join(dir, "iommu_group"))
+	s.writeFile(filepath.Join(s.cfg.Paths.VfioDevices, group), "")
+	s.symlink(dir, filepath.Join(typePath, "devices", uuid))
+	s.symlink(dir, filepath.Join(s.cfg.Paths.MdevDevices, uuid))
+}
+
+// removeMdev removes a vGPU the way writing to its remove file does.
+func (s *fakeSysfs) removeMdev(parent string, uuid string) {
+	s.t.Helper()
+	dir := filepath.Join(s.devicePath(parent), uuid)
+	typePath, err := os.Readlink(filepath.Join(dir, "mdev_type"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join(s.cfg.Paths.MdevDevices, uuid),
+		filepath.Join(typePath, "devices", uuid),
+		dir,
+	} {
+		if err := os.RemoveAll(path); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+}
+
+// applyWrite records a write to a sysfs attribute and applies it the way the
+// kernel does: mdevs are created and removed, driver_override is stored,
+// unbind releases the function and drivers_probe binds it to its override.
+// Functions without an override have no host driver to go back to.
+func (s *fakeSysfs) applyWrite(path string, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rel, _ := filepath.Rel(s.root, path)
+	s.writes = append(s.writes, rel+"="+value)
+
+	dir := filepath.Dir(path)
+	switch filepath.Base(path) {
+	case "create":
+		parent := filepath.Base(filepath.Dir(filepath.Dir(dir)))
+		if err := s.adjustAvailable(dir, -1); err != nil {
+			return err
+		}
+		s.addMdev(parent, filepath.Base(dir), value, strconv.Itoa(s.nextGroup))
+		s.nextGroup++
+	case "remove":
+		mdev, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return err
+		}
+		typePath, err := os.Readlink(filepath.Join(mdev, "mdev_type"))
+		if err != nil {
+			return err
+		}
+		s.removeMdev(filepath.Base(filepath.Dir(mdev)), filepath.Base(mdev))
+		return s.adjustAvailable(typePath, 1)
+	case "driver_override":
+		s.writeFile(path, value+"\n")
+	case "unbind":
+		return os.Remove(filepath.Join(s.cfg.Paths.PciDevices, value, "driver"))
+	case "drivers_probe":
+		data, err := os.ReadFile(filepath.Join(s.cfg.Paths.PciDevices, value, "driver_override"))
+		if err != nil {
+			return err
+		}
+		if override := strings.TrimSpace(string(data)); override != "" && override != "(null)" {
+			s.bind(value, override)
+		}
+	default:
+		return fmt.Errorf("fake sysfs: unexpected write to %s", path)
+	}
+	return nil
+}
+
+// adjustAvailable changes available_instances of an mdev type, failing like
+// the kernel does when no instance is left.
+func (s *fakeSysfs) adjustAvailable(typePath string, delta int) error {
+	available, err := readMdevAvailableInstances(typePath)
+	if err != nil {
+		return err
+	}
+	if available+delta < 0 {
+		return fmt.Errorf("no space left on device")
+	}
+	s.writeFile(filepath.Join(typePath, "available_instances"), fmt.Sprintf("%d\n", available+delta))
+	return nil
+}
+
+// sysfsWrites returns the writes applied so far.
+func (s *fakeSysfs) sysfsWrites() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.writes...)
+}
+
+func (s *fakeSysfs) mkdir(dir string) {
+	s.t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func (s *fakeSysfs) writeFile(path string, content string) {
+	s.t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func (s *fakeSysfs) symlink(target string, link string) {
+	s.t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		s.t.Fatal(err)
+	}
+}
@@ -7,52 +7,83 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 const (
-	DeviceNamespace = "xdxct.com"
-	vfioDevicePath  = "/dev/vfio"
-	gpuPrefix       = "PCI_RESOURCE_XDXCT_COM"
-	vgpuPrefix      = "MDEV_PCI_RESOURCE_XDXCT_COM"
-	connectTimeOut  = 5 * time.Second
+	vfioDevicePath = "/dev/vfio"
+	gpuPrefix      = "PCI_RESOURCE"
+	vgpuPrefix     = "MDEV_PCI_RESOURCE"
+	connectTimeOut = 5 * time.Second
+	// how long Stop lets in-flight calls finish before closing connections
+	serverStopTimeout = 5 * time.Second
 )
 
-var returnIommuMap = getIommuMap
+// DeviceNamespace prefixes the vGPU resource names and the passthrough resource
+// names outside of device sets, see Config.ResourceNamespace.
+var DeviceNamespace = "xdxct.com"
+
+// deviceBackend is the device specific part of a device plugin. Serving,
+// registration with kubelet, ListAndWatch streaming and the restart on kubelet
+// restarts are shared by every backend in GenericDevicePlugin.
+type deviceBackend interface {
+	// enumerate returns the devices currently advertised under the resource.
+	enumerate(deviceName string) []*pluginapi.Device
+	// allocate prepares the given devices for one container.
+	allocate(dp *GenericDevicePlugin, ids []string) (*pluginapi.ContainerAllocateResponse, error)
+	// preferredAllocation picks the devices to prefer for each container request.
+	preferredAllocation(in *pluginapi.PreferredAllocationRequest) *pluginapi.PreferredAllocationResponse
+	// healthCheck reports health changes of the plugin's devices through
+	// dp.reportHealth until ctx is canceled.
+	healthCheck(ctx context.Context, dp *GenericDevicePlugin) error
+}
 
 type GenericDevicePlugin struct {
-	devs       []*pluginapi.Device
+	backend    deviceBackend
+	state      *deviceState
+	lock       sync.Mutex // guards runCtx and status
+	runLock    sync.Mutex // serializes Start, Stop and restart, guards the fields below
 	server     *grpc.Server
-	stop       chan struct{}
-	term       chan bool // this channel detects kubelet restarts
-	healthy    chan string
-	unhealthy  chan string
+	ctx        context.Context // the lifetime of the plugin, derived from the one passed to Start
+	cancel     context.CancelFunc
+	runCtx     context.Context // the lifetime of the current server, derived from ctx
+	runCancel  context.CancelFunc
+	wg         sync.WaitGroup // the health and registration goroutines of the current server
+	rewatch    chan struct{}  // the devices were replaced, resync the health watches
 	sockPath   string
 	deviceName string
-	devicePath string
+	namespace  string
+	status     pluginStatus // guarded by lock, see probes.go
 }
 
-func NewGenericaDevicePlugin(deviceName string, devicePath string, devices []*pluginapi.Device) *GenericDevicePlugin {
-	serverSock := fmt.Sprintf(pluginapi.DevicePluginPath+"kubevirt-%s.sock", deviceName)
+func newGenericDevicePlugin(deviceName string, namespace string, backend deviceBackend) *GenericDevicePlugin {
+	serverSock := filepath.Join(devicePluginPath, fmt.Sprintf("kubevirt-%s.sock", deviceName))
 
 	return &GenericDevicePlugin{
-		devs:       devices,
+		backend:    backend,
+		state:      newDeviceState(backend.enumerate(deviceName)),
 		sockPath:   serverSock,
-		term:       make(chan bool, 1),
-		healthy:    make(chan string),
-		unhealthy:  make(chan string),
+		rewatch:    make(chan struct{}, 1),
 		deviceName: deviceName,
-		devicePath: devicePath,
+		namespace:  namespace,
 	}
 }
 
+// resourceName returns the name the plugin is registered under, e.g.
+// xdxct.com/Pangu_A0.
+func (dp *GenericDevicePlugin) resourceName() string {
+	return fmt.Sprintf("%s/%s", dp.namespace, dp.deviceName)
+}
+
 func waitForGrpcServer(sockPath string, timeout time.Duration) error {
 	conn, err := connect(sockPath, timeout)
 	if err != nil {
@@ -77,6 +108,14 @@ func connect(sockPath string, timeout time.Duration) (*grpc.ClientConn, error) {
 	return g, nil
 }
 
+// resourceEnvName returns the variable KubeVirt reads the allocated devices of
+// a resource from, e.g. PCI_RESOURCE_XDXCT_COM_PANGU_A0 for xdxct.com/Pangu_A0.
+func resourceEnvName(prefix string, resourceName string) string {
+	name := strings.ToUpper(resourceName)
+	name = strings.NewReplacer("/", "_", ".", "_").Replace(name)
+	return fmt.Sprintf("%s_%s", prefix, name)
+}
+
 func buildEnv(envList map[string][]string) map[string]string {
 	env := map[string]string{}
 	for key, pcieList := range envList {
@@ -85,20 +124,45 @@ func buildEnv(envList map[string][]string) map[string]string {
 	return env
 }
 
-func (dp *GenericDevicePlugin) Start(stop chan struct{}) error {
+// Start serves the plugin until ctx is canceled or Stop is called. The plugin
+// restarts its server under the same context when kubelet removes its socket.
+func (dp *GenericDevicePlugin) Start(ctx context.Context) error {
+	dp.runLock.Lock()
+	defer dp.runLock.Unlock()
 	if dp.server != nil {
 		return fmt.Errorf("grpc server already start")
 	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("not starting %s device plugin, shutting down", dp.deviceName)
+	}
+
+	dp.ctx, dp.cancel = context.WithCancel(ctx)
+	if err := dp.serve(); err != nil {
+		dp.cancel()
+		return err
+	}
+	return nil
+}
 
-	dp.stop = stop
+// serve starts a gRPC server and the goroutines belonging to it, all ended by
+// the context of the run. The caller must hold runLock.
+func (dp *GenericDevicePlugin) serve() error {
+	runCtx, runCancel := context.WithCancel(dp.ctx)
+	dp.lock.Lock()
+	dp.runCtx = runCtx
+	dp.status = pluginStatus{}
+	dp.lock.Unlock()
+	dp.runCancel = runCancel
 
 	if err := dp.cleanup(); err != nil {
+		runCancel()
 		return err
 	}
 
 	sock, err := net.Listen("unix", dp.sockPath)
 	if err != nil {
 		log.Printf("Errorf %s connect to GRPC socket: %v", dp.deviceName, err)
+		runCancel()
 		return err
 	}
 	dp.server = grpc.NewServer([]grpc.ServerOption{}...)
@@ -109,17 +173,23 @@ func (dp *GenericDevicePlugin) Start(stop chan struct{}) error {
 	err = waitForGrpcServer(dp.sockPath, connectTimeOut)
 	if err != nil {
 		log.Printf("Errorf %s connect to GRPC server: %v", dp.deviceName, err)
+		dp.stopServing()
 		return err
 	}
 
-	err = dp.Register()
-	if err != nil {
-		log.Printf("Errorf %s register device plugin: %v", dp.deviceName, err)
-	}
+	dp.setServing(true)
 
-	go dp.healthyCheck()
+	dp.wg.Add(2)
+	go func() {
+		defer dp.wg.Done()
+		dp.exited(runCtx, "health check", dp.backend.healthCheck(runCtx, dp))
+	}()
+	go func() {
+		defer dp.wg.Done()
+		dp.exited(runCtx, "registration", dp.superviseRegistration(runCtx))
+	}()
 
-	log.Println(dp.deviceName + "Device Plugin server ready")
+	log.Println(dp.deviceName + " Device Plugin server ready")
 	return nil
 }
 
@@ -131,30 +201,75 @@ func (dp *GenericDevicePlugin) cleanup() error {
 	return nil
 }
 
+// Stop ends the plugin for good, a plugin restarting at the same time does not
+// come back.
 func (dp *GenericDevicePlugin) Stop() error {
+	dp.runLock.Lock()
+	defer dp.runLock.Unlock()
+	if dp.cancel != nil {
+		dp.cancel()
+	}
 	if dp.server == nil {
 		return nil
 	}
+	return dp.stopServing()
+}
 
-	dp.term <- true
-	dp.server.Stop()
+// stopServing stops the current gRPC server and waits for the goroutines of
+// the run. The caller must hold runLock.
+func (dp *GenericDevicePlugin) stopServing() error {
+	dp.setServing(false)
+	// ends the ListAndWatch streams, so the graceful stop does not wait for them
+	dp.runCancel()
+	stopServer(dp.server, serverStopTimeout)
+	dp.wg.Wait()
 	dp.server = nil
 
 	return dp.cleanup()
 }
 
+// stopServer stops the server gracefully, closing the connections of calls
+// still running after timeout.
+func stopServer(server *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		server.Stop()
+		<-done
+	}
+}
+
+// restart replaces the gRPC server of a running plugin. It does nothing if the
+// plugin was stopped or its context canceled in the meantime.
 func (dp *GenericDevicePlugin) restart() error {
+	dp.runLock.Lock()
+	defer dp.runLock.Unlock()
+	if dp.ctx == nil || dp.ctx.Err() != nil {
+		return nil
+	}
 	log.Printf("Restarting %s device Plugin server", dp.deviceName)
-	if dp.server == nil {
-		return fmt.Errorf("grpc server instance not found for %s", dp.deviceName)
+	if dp.server != nil {
+		if err := dp.stopServing(); err != nil {
+			return err
+		}
 	}
-	dp.Stop()
-	var stop = make(chan struct{})
-	return dp.Start(stop)
+	return dp.serve()
+}
+
+// done is closed once the plugin is stopped for good.
+func (dp *GenericDevicePlugin) done() <-chan struct{} {
+	dp.runLock.Lock()
+	defer dp.runLock.Unlock()
+	return dp.ctx.Done()
 }
 
 func (dp *GenericDevicePlugin) Register() error {
-	conn, err := connect(pluginapi.KubeletSocket, connectTimeOut)
+	conn, err := connect(kubeletSocket, connectTimeOut)
 	if err != nil {
 		return err
 	}
@@ -164,7 +279,7 @@ func (dp *GenericDevicePlugin) Register() error {
 	req := &pluginapi.RegisterRequest{
 		Version:      pluginapi.Version,
 		Endpoint:     path.Base(dp.sockPath),
-		ResourceName: fmt.Sprintf("%s/%s", DeviceNamespace, dp.deviceName),
+		ResourceName: dp.resourceName(),
 	}
 
 	_, err = client.Register(context.Background(), req)
@@ -176,174 +291,140 @@ func (dp *GenericDevicePlugin) Register() error {
 
 func (dp *GenericDevicePlugin) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	options := &pluginapi.DevicePluginOptions{
-		PreStartRequired: false,
+		PreStartRequired:                false,
+		GetPreferredAllocationAvailable: true,
 	}
 	return options, nil
 }
 
 func (dp *GenericDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{
-		Devices: dp.devs,
-	})
+	dp.lock.Lock()
+	ctx := dp.runCtx
+	dp.lock.Unlock()
+
+	dp.streamStarted()
+	defer dp.streamEnded()
 
+	var sent uint64
 	for {
-		select {
-		case unhealthy := <-dp.unhealthy:
-			log.Printf("In watch unhealthy")
-			for _, dev := range dp.devs {
-				if unhealthy == dev.ID {
-					dev.Health = pluginapi.Unhealthy
-				}
-			}
-			s.Send(&pluginapi.ListAndWatchResponse{
-				Devices: dp.devs,
-			})
-		case healthy := <-dp.healthy:
-			log.Printf("In watch healthy")
-			for _, dev := range dp.devs {
-				if healthy == dev.ID {
-					dev.Health = pluginapi.Healthy
-				}
+		devs, version, changed := dp.state.snapshot()
+		if version != sent {
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				log.Printf("%s: ListAndWatch stream to kubelet failed: %v", dp.deviceName, err)
+				return err
 			}
-			s.Send(&pluginapi.ListAndWatchResponse{
-				Devices: dp.devs,
-			})
-		case <-dp.stop:
+			sent = version
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
 			return nil
-		case <-dp.term:
+		case <-s.Context().Done():
 			return nil
 		}
 	}
 }
 
-func (dp *GenericDevicePlugin) GetPreferredAllocation(ctx context.Context, in *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	return nil, nil
+// devices returns a copy of the advertised devices.
+func (dp *GenericDevicePlugin) devices() []*pluginapi.Device {
+	devs, _, _ := dp.state.snapshot()
+	return devs
 }
 
-func (dp *GenericDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	log.Println("In allocate")
-	responses := pluginapi.AllocateResponse{}
-	envList := map[string][]string{}
+func (dp *GenericDevicePlugin) deviceIDs() []string {
+	return dp.state.ids()
+}
 
-	for _, req := range reqs.ContainerRequests {
-		deviceSpecs := make([]*pluginapi.DeviceSpec, 0)
-		for _, iommuId := range req.DevicesIDs {
-			devAddrs := []string{}
-
-			returnedMap := returnIommuMap()
-			//Retrieve the devices associated with a Iommu group
-			xdxDev := returnedMap[iommuId]
-			for _, dev := range xdxDev {
-				iommuGroup, err := readLink(basePciPath, dev.addr, "iommu_group")
-				if err != nil || iommuGroup != iommuId {
-					log.Println("IommuGroup has changed on the system ", dev.addr)
-					return nil, fmt.Errorf("invalid allocation request: unknown device: %s", dev.addr)
-				}
-				vendorID, err := readIDFromFile(basePciPath, dev.addr, "vendor")
-				if err != nil || vendorID != "1eed" {
-					log.Println("Vendor has changed on the system ", dev.addr)
-					return nil, fmt.Errorf("invalid allocation request: unknown device: %s", dev.addr)
-				}
-
-				devAddrs = append(devAddrs, dev.addr)
+func deviceIDsOf(devs []*pluginapi.Device) []string {
+	ids := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		ids = append(ids, dev.ID)
+	}
+	return ids
+}
 
-			}
-			deviceSpecs = append(deviceSpecs, &pluginapi.DeviceSpec{
-				HostPath:      filepath.Join(vfioDevicePath, "vfio"),
-				ContainerPath: filepath.Join(vfioDevicePath, "vfio"),
-				Permissions:   "mrw",
-			})
-			deviceSpecs = append(deviceSpecs, &pluginapi.DeviceSpec{
-				HostPath:      filepath.Join(vfioDevicePath, iommuId),
-				ContainerPath: filepath.Join(vfioDevicePath, iommuId),
-				Permissions:   "mrw",
-			})
-
-			key := fmt.Sprintf("%s_%s", gpuPrefix, dp.deviceName)
-			if _, exists := envList[key]; !exists {
-				envList[key] = []string{}
-			}
-			envList[key] = append(envList[key], devAddrs...)
-		}
-		envs := buildEnv(envList)
-		log.Printf("Allocated devices: %s", envs)
-		response := pluginapi.ContainerAllocateResponse{
-			Envs:    envs,
-			Devices: deviceSpecs,
-		}
+// refresh enumerates the devices of the plugin again and pushes them to kubelet
+// if they or their NUMA nodes changed.
+func (dp *GenericDevicePlugin) refresh() {
+	devs := dp.backend.enumerate(dp.deviceName)
+	if current, _, _ := dp.state.snapshot(); sameDevices(devs, current) {
+		return
+	}
+	log.Printf("%s devices changed: %v", dp.deviceName, deviceIDsOf(devs))
+	dp.updateDevices(devs)
+}
 
-		responses.ContainerResponses = append(responses.ContainerResponses, &response)
+// sameDevices reports whether a and b hold the same devices on the same NUMA
+// nodes, whatever their health.
+func sameDevices(a []*pluginapi.Device, b []*pluginapi.Device) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	return &responses, nil
+	for i := range a {
+		if a[i].ID != b[i].ID || !reflect.DeepEqual(numaNodeIDs(a[i]), numaNodeIDs(b[i])) {
+			return false
+		}
+	}
+	return true
 }
 
-func (dp *GenericDevicePlugin) PreStartContainer(ctx context.Context, in *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	res := &pluginapi.PreStartContainerResponse{}
-	return res, nil
+func numaNodeIDs(dev *pluginapi.Device) []int64 {
+	var ids []int64
+	if dev.Topology != nil {
+		for _, node := range dev.Topology.Nodes {
+			ids = append(ids, node.ID)
+		}
+	}
+	return ids
 }
 
-func (dp *GenericDevicePlugin) healthyCheck() error {
-	method := fmt.Sprintf("healthCheck(%s)", dp.deviceName)
-	log.Printf("%s: invoked", method)
-	var pathDeviceMap = make(map[string]string)
-	var path = dp.devicePath
-	var health = ""
+// updateDevices replaces the advertised devices after rediscovery. Devices
+// that were already advertised keep their current health.
+func (dp *GenericDevicePlugin) updateDevices(devs []*pluginapi.Device) {
+	dp.state.replace(devs)
+	notify(dp.rewatch)
+}
 
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Printf("%s: unable to create fsnotify watcher: %v", method, err)
-		return err
+// notify performs a non-blocking send on a buffered signal channel.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
 	}
-	defer watcher.Close()
+}
 
-	err = watcher.Add(filepath.Dir(dp.sockPath))
-	if err != nil {
-		log.Printf("%s: Unable to add device socket path to fsnotify watcher: %v", method, err)
-		return err
+// reportHealth records a health change, every ListAndWatch stream sends it to
+// kubelet. An actual change is recorded as an event as well, cause describes
+// why the device became unhealthy.
+func (dp *GenericDevicePlugin) reportHealth(id string, health string, cause string) {
+	if dp.state.setHealth(id, health) {
+		deviceEvents.deviceHealthChanged(dp.resourceName(), id, health, cause)
 	}
+}
 
-	_, err = os.Stat(path)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("%s: Unable to stat device: %v", method, err)
-			return err
-		}
-	}
+func (dp *GenericDevicePlugin) GetPreferredAllocation(ctx context.Context, in *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	return dp.backend.preferredAllocation(in), nil
+}
+
+func (dp *GenericDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	log.Println("In allocate")
+	allocateRequests.WithLabelValues(dp.deviceName).Inc()
+	responses := pluginapi.AllocateResponse{}
 
-	for _, dev := range dp.devs {
-		devicePath := filepath.Join(path, dev.ID)
-		err = watcher.Add(devicePath)
-		pathDeviceMap[devicePath] = dev.ID
+	for _, req := range reqs.ContainerRequests {
+		response, err := dp.backend.allocate(dp, req.DevicesIDs)
 		if err != nil {
-			log.Printf("%s: Unable to add device path to fsnotify watcher: %v", method, err)
-			return err
+			allocateFailures.WithLabelValues(dp.deviceName).Inc()
+			deviceEvents.allocationRejected(dp.resourceName(), status.Convert(err).Message())
+			return nil, err
 		}
+		log.Printf("Allocated devices: %s", response.Envs)
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
 	}
+	return &responses, nil
+}
 
-	for {
-		select {
-		case <-dp.stop:
-			return nil
-		case event := <-watcher.Events:
-			v, ok := pathDeviceMap[event.Name]
-			if ok {
-				if event.Op == fsnotify.Create {
-					health = v
-					dp.healthy <- health
-				} else if (event.Op == fsnotify.Remove) || (event.Op == fsnotify.Rename) {
-					log.Printf("%s: Marking device unhealthy: %s", method, event.Name)
-					health = v
-					dp.unhealthy <- health
-				}
-			} else if event.Name == dp.sockPath && event.Op == fsnotify.Remove {
-				log.Printf("%s: Socket path for GPU device was removed, kubelet likely restarted", method)
-				if err := dp.restart(); err != nil {
-					log.Printf("%s: Unable to restart server %v", method, err)
-					return err
-				}
-				log.Printf("%s: Successfully restarted %s device plugin server. Terminating.", method, dp.deviceName)
-				return nil
-			}
-		}
-	}
+func (dp *GenericDevicePlugin) PreStartContainer(ctx context.Context, in *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	res := &pluginapi.PreStartContainerResponse{}
+	return res, nil
 }
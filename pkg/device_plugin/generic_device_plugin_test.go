@@ -0,0 +1,349 @@
+package device_plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestPciDevicePluginRegisterAndListAndWatch(t *testing.T) {
+	newTestHost(t)
+	kubelet := newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+
+	req := kubelet.waitForRegistration(t)
+	if req.ResourceName != "xdxct.com/1330" || req.Endpoint != "kubevirt-1330.sock" || req.Version != pluginapi.Version {
+		t.Errorf("unexpected registration %v", req)
+	}
+
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	want := map[string]string{"7": pluginapi.Healthy, "8": pluginapi.Healthy}
+	if got := recvDevices(t, stream); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListAndWatch = %v, want %v", got, want)
+	}
+}
+
+func TestPciDevicePluginAllocate(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	client := dialDevicePlugin(t, dp)
+
+	resp, err := client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"8"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ContainerResponses) != 1 {
+		t.Fatalf("got %d container responses, want 1", len(resp.ContainerResponses))
+	}
+	container := resp.ContainerResponses[0]
+	wantEnvs := map[string]string{"PCI_RESOURCE_XDXCT_COM_1330": "0000:3c:00.0,0000:3c:00.1"}
+	if !reflect.DeepEqual(container.Envs, wantEnvs) {
+		t.Errorf("Envs = %v, want %v", container.Envs, wantEnvs)
+	}
+	var paths []string
+	for _, spec := range container.Devices {
+		paths = append(paths, spec.HostPath)
+	}
+	if want := []string{"/dev/vfio/vfio", "/dev/vfio/8"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("device specs = %v, want %v", paths, want)
+	}
+	if len(container.CDIDevices) != 1 || container.CDIDevices[0].Name != "xdxct.com/gpu=8" {
+		t.Errorf("CDI devices = %v, want xdxct.com/gpu=8", container.CDIDevices)
+	}
+}
+
+func TestDeviceSetPluginAllocate(t *testing.T) {
+	newAcceleratorHost(t)
+	kubelet := newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("accel-1234", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	if req := kubelet.waitForRegistration(t); req.ResourceName != "example.com/accel-1234" {
+		t.Errorf("registered %s, want example.com/accel-1234", req.ResourceName)
+	}
+
+	resp, err := dialDevicePlugin(t, dp).Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"40"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := resp.ContainerResponses[0]
+	wantEnvs := map[string]string{"PCI_RESOURCE_EXAMPLE_COM_ACCEL-1234": "0000:81:00.0"}
+	if !reflect.DeepEqual(container.Envs, wantEnvs) {
+		t.Errorf("Envs = %v, want %v", container.Envs, wantEnvs)
+	}
+	if len(container.CDIDevices) != 1 || container.CDIDevices[0].Name != "example.com/gpu=40" {
+		t.Errorf("CDI devices = %v, want example.com/gpu=40", container.CDIDevices)
+	}
+}
+
+func TestPciDevicePluginAllocateMovedGroup(t *testing.T) {
+	s := newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+
+	// the GPU ended up in another IOMMU group since it was discovered
+	s.moveToIommuGroup("0000:3c:00.0", "9")
+
+	_, err := dialDevicePlugin(t, dp).Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"8"}}},
+	})
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "0000:3c:00.0") {
+		t.Errorf("Allocate error = %v, want %s naming 0000:3c:00.0", err, codes.FailedPrecondition)
+	}
+
+	// the GPU no longer matches a selector since it was discovered
+	cfg := *s.cfg
+	cfg.Selectors = []DeviceSelector{{Vendor: "1eed", Class: "040300"}}
+	swapConfig(&cfg)
+	_, err = dialDevicePlugin(t, dp).Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"7"}}},
+	})
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "0000:3b:00.0") {
+		t.Errorf("Allocate error = %v, want %s naming 0000:3b:00.0", err, codes.FailedPrecondition)
+	}
+}
+
+func TestPciDevicePluginAllocateRemovedGroup(t *testing.T) {
+	s := newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+
+	// rediscovery dropped group 8 before kubelet saw the updated list
+	for _, addr := range []string{"0000:3c:00.0", "0000:3c:00.1"} {
+		if err := os.Remove(filepath.Join(s.devicePath(addr), "driver")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createIommuDeviceMap()
+
+	_, err := dialDevicePlugin(t, dp).Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"8"}}},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Allocate error = %v, want %s", err, codes.FailedPrecondition)
+	}
+}
+
+func TestPciDevicePluginUnhealthy(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	recvDevices(t, stream)
+
+	if err := os.RemoveAll(filepath.Join(iommuGroupBasePath, "7")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"7": pluginapi.Unhealthy, "8": pluginapi.Healthy}
+	if got := recvDevices(t, stream); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListAndWatch = %v, want %v", got, want)
+	}
+}
+
+func TestPciDevicePluginUnhealthyWithoutStream(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+
+	waitForReady(t, dp)
+	// nobody is watching, the health check must not wait for a stream
+	if err := os.RemoveAll(filepath.Join(iommuGroupBasePath, "7")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(testTimeout)
+	for dp.devices()[0].Health != pluginapi.Unhealthy {
+		if time.Now().After(deadline) {
+			t.Fatal("device 7 was not marked unhealthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	want := map[string]string{"7": pluginapi.Unhealthy, "8": pluginapi.Healthy}
+	if got := recvDevices(t, stream); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListAndWatch = %v, want %v", got, want)
+	}
+}
+
+func TestListAndWatchFanOut(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	client := dialDevicePlugin(t, dp)
+	streams := []pluginapi.DevicePlugin_ListAndWatchClient{listAndWatch(t, client), listAndWatch(t, client), listAndWatch(t, client)}
+	for _, stream := range streams {
+		recvDevices(t, stream)
+	}
+
+	if err := os.RemoveAll(filepath.Join(iommuGroupBasePath, "8")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"7": pluginapi.Healthy, "8": pluginapi.Unhealthy}
+	for i, stream := range streams {
+		if got := recvDevices(t, stream); !reflect.DeepEqual(got, want) {
+			t.Errorf("stream %d: ListAndWatch = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestVgpuDevicePluginHealthTransitions(t *testing.T) {
+	s := newTestHost(t)
+	newFakeKubelet(t)
+	createVgpuMap()
+	setDuration(t, &vgpuHealthCheckInterval, 50*time.Millisecond)
+
+	const parent, typeDir = "0000:5e:00.0", "xgv-XGV_V0_1G_1_CORE"
+	const uuid = "9d5c5a1e-1b4a-4e0a-8a3e-000000000002"
+	dp := NewGenericaVgpuDevicePlugin("XGV_V0_1G_1_CORE", vGpuBasePath)
+	startTestPlugin(t, dp)
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	recvDevices(t, stream)
+
+	s.removeMdev(parent, uuid)
+	if got := recvDevices(t, stream); got[uuid] != pluginapi.Unhealthy {
+		t.Errorf("vGPU %s is %s after removal, want %s", uuid, got[uuid], pluginapi.Unhealthy)
+	}
+
+	s.addMdev(parent, typeDir, uuid, "22")
+	if got := recvDevices(t, stream); got[uuid] != pluginapi.Healthy {
+		t.Errorf("vGPU %s is %s after recreation, want %s", uuid, got[uuid], pluginapi.Healthy)
+	}
+}
+
+// The health survives a restart of the plugin, so a vGPU that went unhealthy
+// before kubelet restarted must still be reported healthy once it is back.
+func TestVgpuDevicePluginRecoversAfterRestart(t *testing.T) {
+	s := newTestHost(t)
+	kubelet := newFakeKubelet(t)
+	createVgpuMap()
+	setDuration(t, &vgpuHealthCheckInterval, 50*time.Millisecond)
+
+	const parent, typeDir = "0000:5e:00.0", "xgv-XGV_V0_1G_1_CORE"
+	const uuid = "9d5c5a1e-1b4a-4e0a-8a3e-000000000002"
+	dp := NewGenericaVgpuDevicePlugin("XGV_V0_1G_1_CORE", vGpuBasePath)
+	startTestPlugin(t, dp)
+	kubelet.waitForRegistration(t)
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	recvDevices(t, stream)
+
+	s.removeMdev(parent, uuid)
+	if got := recvDevices(t, stream); got[uuid] != pluginapi.Unhealthy {
+		t.Fatalf("vGPU %s is %s after removal, want %s", uuid, got[uuid], pluginapi.Unhealthy)
+	}
+
+	if err := os.Remove(dp.sockPath); err != nil {
+		t.Fatal(err)
+	}
+	waitForStreamEnd(t, stream)
+	kubelet.waitForRegistration(t)
+	waitForReady(t, dp)
+	stream = listAndWatch(t, dialDevicePlugin(t, dp))
+	if got := recvDevices(t, stream); got[uuid] != pluginapi.Unhealthy {
+		t.Fatalf("vGPU %s is %s after the restart, want %s", uuid, got[uuid], pluginapi.Unhealthy)
+	}
+
+	s.addMdev(parent, typeDir, uuid, "22")
+	if got := recvDevices(t, stream); got[uuid] != pluginapi.Healthy {
+		t.Errorf("vGPU %s is %s after recreation, want %s", uuid, got[uuid], pluginapi.Healthy)
+	}
+}
+
+func TestVgpuDevicePluginAllocate(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	createVgpuMap()
+
+	dp := NewGenericaVgpuDevicePlugin("XGV_V0_1G_1_CORE", vGpuBasePath)
+	startTestPlugin(t, dp)
+
+	const uuid = "9d5c5a1e-1b4a-4e0a-8a3e-000000000001"
+	resp, err := dialDevicePlugin(t, dp).Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{uuid}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantEnvs := map[string]string{"MDEV_PCI_RESOURCE_XDXCT_COM_XGV_V0_1G_1_CORE": uuid}
+	if got := resp.ContainerResponses[0].Envs; !reflect.DeepEqual(got, wantEnvs) {
+		t.Errorf("Envs = %v, want %v", got, wantEnvs)
+	}
+	var mounts []string
+	for _, spec := range resp.ContainerResponses[0].Devices {
+		mounts = append(mounts, spec.HostPath)
+	}
+	if want := []string{"/dev/vfio/vfio", "/dev/vfio/21"}; !reflect.DeepEqual(mounts, want) {
+		t.Errorf("Devices = %v, want %v", mounts, want)
+	}
+}
+
+func TestVgpuAllocateRejected(t *testing.T) {
+	const parent, uuid = "0000:5e:00.0", "9d5c5a1e-1b4a-4e0a-8a3e-000000000001"
+	for _, tc := range []struct {
+		name   string
+		change func(s *fakeSysfs)
+	}{
+		{"removed", func(s *fakeSysfs) { s.removeMdev(parent, uuid) }},
+		{"rebound", func(s *fakeSysfs) { s.bind(parent, "vfio-pci") }},
+		{"unbound", func(s *fakeSysfs) { os.Remove(filepath.Join(s.devicePath(parent), "driver")) }},
+		{"retyped", func(s *fakeSysfs) {
+			s.addMdevType(parent, "xgv-XGV_V0_2G_2_CORE", "XGV_V0_2G_2_CORE", 1)
+			link := filepath.Join(s.devicePath(parent), uuid, "mdev_type")
+			os.Remove(link)
+			s.symlink(filepath.Join(s.devicePath(parent), "mdev_supported_types", "xgv-XGV_V0_2G_2_CORE"), link)
+		}},
+		{"nogroup", func(s *fakeSysfs) { os.Remove(filepath.Join(s.devicePath(parent), uuid, "iommu_group")) }},
+		{"nonode", func(s *fakeSysfs) { os.Remove(filepath.Join(s.cfg.Paths.VfioDevices, "21")) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestHost(t)
+			newFakeKubelet(t)
+			createVgpuMap()
+
+			dp := NewGenericaVgpuDevicePlugin("XGV_V0_1G_1_CORE", vGpuBasePath)
+			startTestPlugin(t, dp)
+			tc.change(s)
+
+			_, err := dialDevicePlugin(t, dp).Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{uuid}}},
+			})
+			if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), uuid) {
+				t.Errorf("Allocate() = %v, want FailedPrecondition naming %s", err, uuid)
+			}
+		})
+	}
+}
@@ -4,312 +4,237 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net"
 	"os"
-	"path"
 	"path/filepath"
+	"sync"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-type GenericVgpuDevicePlugin struct {
-	devs       []*pluginapi.Device
-	server     *grpc.Server
-	stop       chan struct{}
-	term       chan bool // this channel detects kubelet restarts
-	healthy    chan string
-	unhealthy  chan string
-	sockPath   string
-	deviceName string
-	devicePath string
+var vgpuHealthCheckInterval = 5 * time.Second
+
+// vgpuBackend advertises mediated devices (vGPUs) of one or more types.
+type vgpuBackend struct {
+	devicePath string // the mdev bus directory
+
+	lock    sync.Mutex
+	parents map[string]mdevParent // the parent of every advertised mdev when it was discovered
 }
 
-func NewGenericaVgpuDevicePlugin(deviceName string, devicePath string, devices []*pluginapi.Device) *GenericVgpuDevicePlugin {
-	serverSock := fmt.Sprintf(pluginapi.DevicePluginPath+"kubevirt-%s.sock", deviceName)
-	dpi := &GenericVgpuDevicePlugin{
-		deviceName: deviceName,
-		sockPath:   serverSock,
-		devicePath: devicePath,
-		devs:       devices,
-		term:       make(chan bool, 1),
-		healthy:    make(chan string),
-		unhealthy:  make(chan string),
-	}
-	return dpi
+func NewGenericaVgpuDevicePlugin(deviceName string, devicePath string) *GenericDevicePlugin {
+	return newGenericDevicePlugin(deviceName, DeviceNamespace, &vgpuBackend{devicePath: devicePath, parents: make(map[string]mdevParent)})
 }
 
-func (dpi *GenericVgpuDevicePlugin) Start(stop chan struct{}) error {
-	if dpi.server != nil {
-		return fmt.Errorf("grpc server already start")
+func (b *vgpuBackend) enumerate(deviceName string) []*pluginapi.Device {
+	deviceMapLock.RLock()
+	devs := buildVgpuDevices(vgpuResources(vGpuMap)[deviceName], gpuVgpuMap)
+	deviceMapLock.RUnlock()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	parents := make(map[string]mdevParent, len(devs))
+	for _, dev := range devs {
+		parent, ok := b.parents[dev.ID]
+		if !ok {
+			var err error
+			if parent, err = readMdevParent(dev.ID); err != nil {
+				log.Printf("[%s] unable to resolve parent GPU of vGPU %s: %v", deviceName, dev.ID, err)
+			}
+		}
+		parents[dev.ID] = parent
 	}
+	b.parents = parents
+	return devs
+}
 
-	dpi.stop = stop
-
-	if err := dpi.cleanup(); err != nil {
-		return err
+// checkAllocatable returns why the mdev cannot be handed to a VM requesting
+// deviceName, or nil.
+func (b *vgpuBackend) checkAllocatable(deviceName string, uuid string) error {
+	b.lock.Lock()
+	expected, ok := b.parents[uuid]
+	b.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("vGPU %s is not advertised as %s", uuid, deviceName)
 	}
-
-	sock, err := net.Listen("unix", dpi.sockPath)
-	if err != nil {
-		log.Printf("Errof %s connect to GRPC socker: %v", dpi.deviceName, err)
+	if err := checkMdevHealth(uuid, expected); err != nil {
 		return err
 	}
-
-	dpi.server = grpc.NewServer([]grpc.ServerOption{}...)
-	pluginapi.RegisterDevicePluginServer(dpi.server, dpi)
-
-	go dpi.server.Serve(sock)
-
-	err = waitForGrpcServer(dpi.sockPath, connectTimeOut)
+	name, err := readVgpuIDFromFile(b.devicePath, uuid, "mdev_type/name")
 	if err != nil {
-		log.Printf("[%s] failed to connnect to GRPC server: %v", dpi.deviceName, err)
+		return fmt.Errorf("unable to read type of vGPU %s: %v", uuid, err)
 	}
-
-	err = dpi.Register()
-	if err != nil {
-		log.Printf("[%s] failed to register with device plugin manager: %v", dpi.deviceName, err)
+	if resource := getConfig().mdevResourceName(name); resource != deviceName {
+		return fmt.Errorf("vGPU %s is of type %s, not %s", uuid, name, deviceName)
 	}
-
-	go dpi.healthCheck()
-
-	log.Println(dpi.deviceName + ": Device plugin Server ready")
 	return nil
 }
 
-func (dpi *GenericVgpuDevicePlugin) Register() error {
-	conn, err := connect(pluginapi.KubeletSocket, connectTimeOut)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	client := pluginapi.NewRegistrationClient(conn)
-	req := &pluginapi.RegisterRequest{
-		Version:      pluginapi.Version,
-		Endpoint:     path.Base(dpi.sockPath),
-		ResourceName: fmt.Sprintf("%s/%s", DeviceNamespace, dpi.deviceName),
-	}
-
-	_, err = client.Register(context.Background(), req)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (dpi *GenericVgpuDevicePlugin) cleanup() error {
-	pattern := filepath.Join(pluginapi.DevicePluginPath, "kubevirt-XGV_V0*.sock")
-	matches, err := filepath.Glob(pattern)
-	if err != nil {
-		fmt.Println("Error matching files:", err)
-		return err
-	}
-
-	for _, match := range matches {
-		err := os.Remove(match)
+// allocate rejects the request if any of the mdevs can no longer be handed to
+// the VM, rather than starting it without its GPU. Only the VFIO groups of the
+// allocated mdevs are mounted.
+func (b *vgpuBackend) allocate(dp *GenericDevicePlugin, ids []string) (*pluginapi.ContainerAllocateResponse, error) {
+	deviceName := dp.deviceName
+	deviceSpecs := []*pluginapi.DeviceSpec{{
+		HostPath:      filepath.Join(vfioDevicePath, "vfio"),
+		ContainerPath: filepath.Join(vfioDevicePath, "vfio"),
+		Permissions:   "mrw",
+	}}
+	envList := map[string][]string{}
+	groups := make(map[string]bool)
+	for _, uuid := range ids {
+		if err := b.checkAllocatable(deviceName, uuid); err != nil {
+			log.Printf("[%s] Rejecting allocation: %v", deviceName, err)
+			return nil, status.Errorf(codes.FailedPrecondition, "invalid allocation request for vGPU %s: %v", uuid, err)
+		}
+		group, err := mdevIommuGroup(b.devicePath, uuid)
 		if err != nil {
-			fmt.Println("Error deleting file:", err)
-		} else {
-			fmt.Println("Deleted file:", match)
+			log.Printf("[%s] Rejecting allocation: %v", deviceName, err)
+			return nil, status.Errorf(codes.FailedPrecondition, "invalid allocation request for vGPU %s: %v", uuid, err)
+		}
+		if !groups[group] {
+			groups[group] = true
+			deviceSpecs = append(deviceSpecs, &pluginapi.DeviceSpec{
+				HostPath:      filepath.Join(vfioDevicePath, group),
+				ContainerPath: filepath.Join(vfioDevicePath, group),
+				Permissions:   "mrw",
+			})
 		}
-	}
-	return nil
-}
 
-func (dpi *GenericVgpuDevicePlugin) Stop() error {
-	if dpi.server == nil {
-		return nil
+		key := resourceEnvName(vgpuPrefix, dp.resourceName())
+		envList[key] = append(envList[key], uuid)
 	}
-
-	dpi.term <- true
-	dpi.server.Stop()
-	dpi.server = nil
-
-	return dpi.cleanup()
+	return &pluginapi.ContainerAllocateResponse{
+		Envs:       buildEnv(envList),
+		Devices:    deviceSpecs,
+		CDIDevices: cdiDevices(cdiKind(dp.namespace, cdiClassVgpu), ids),
+	}, nil
 }
 
-func (dpi *GenericVgpuDevicePlugin) restart() error {
-	log.Printf("Restarting %s device plugin server", dpi.deviceName)
-	if dpi.server == nil {
-		return fmt.Errorf("grpc server instance not found for %s", dpi.deviceName)
+func (b *vgpuBackend) preferredAllocation(in *pluginapi.PreferredAllocationRequest) *pluginapi.PreferredAllocationResponse {
+	parents := vgpuParents(getGpuVgpuMap())
+	topologyOf := func(uuid string) deviceTopology {
+		parent, ok := parents[uuid]
+		if !ok {
+			var err error
+			if parent, err = readGpuIDFromVgpu(b.devicePath, uuid); err != nil {
+				return deviceTopology{numaNode: -1}
+			}
+		}
+		return readVgpuTopology(parent)
 	}
-
-	dpi.Stop()
-
-	var stop = make(chan struct{})
-	return dpi.Start(stop)
+	return preferredAllocation(in, topologyOf, getConfig().VgpuAllocationPolicy)
 }
 
-func (dpi *GenericVgpuDevicePlugin) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	options := &pluginapi.DevicePluginOptions{
-		PreStartRequired: false,
+// healthCheck polls every mdev advertised by this plugin. fsnotify is of no use
+// here: removing an mdev through its sysfs remove file does not produce an
+// inotify event for the device directory. The health is compared against the
+// device state, which outlives restarts of the plugin.
+func (b *vgpuBackend) healthCheck(ctx context.Context, dp *GenericDevicePlugin) error {
+	parents := make(map[string]mdevParent)
+	track := func(id string) {
+		if _, ok := parents[id]; ok {
+			return
+		}
+		parent, err := readMdevParent(id)
+		if err != nil {
+			log.Printf("[%s] unable to resolve parent GPU of vGPU %s: %v", dp.deviceName, id, err)
+		}
+		parents[id] = parent
+	}
+	for _, id := range dp.deviceIDs() {
+		track(id)
 	}
-	return options, nil
-}
 
-func (dpi *GenericVgpuDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{
-		Devices: dpi.devs,
-	})
+	ticker := time.NewTicker(vgpuHealthCheckInterval)
+	defer ticker.Stop()
 
-	log.Printf("send device info: %v", dpi.devs)
 	for {
 		select {
-		case unhealthy := <-dpi.unhealthy:
-			log.Println("In watch unhealthy")
-			for _, dev := range dpi.devs {
-				if unhealthy == dev.ID {
-					dev.Health = pluginapi.Unhealthy
-				}
-			}
-			s.Send(&pluginapi.ListAndWatchResponse{
-				Devices: dpi.devs,
-			})
-		case healthy := <-dpi.healthy:
-			log.Println("In watch healthy")
-			for _, dev := range dpi.devs {
-				if healthy == dev.ID {
-					dev.Health = pluginapi.Healthy
-				}
-			}
-			s.Send(&pluginapi.ListAndWatchResponse{
-				Devices: dpi.devs,
-			})
-		case <-dpi.stop:
-			return nil
-		case <-dpi.term:
+		case <-ctx.Done():
 			return nil
+		case <-ticker.C:
 		}
-	}
-}
-
-func (dpi *GenericVgpuDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	log.Println("In allocate")
-	responses := pluginapi.AllocateResponse{}
 
-	for _, req := range reqs.ContainerRequests {
-		deviceSpecs := make([]*pluginapi.DeviceSpec, 0)
-		envList := map[string][]string{}
-		for _, str := range req.DevicesIDs {
-			vGpuId, err := readVgpuIDFromFile(vGpuBasePath, str, "mdev_type/name")
-			if err != nil || vGpuId != dpi.deviceName {
-				log.Println("Could not get vGPU type", dpi.deviceName)
-				log.Println("Could not get vGPU type", vGpuId)
-				continue
+		for _, id := range dp.deviceIDs() {
+			track(id)
+			expected := parents[id]
+			if expected.addr == "" || expected.driver == "" {
+				// the parent was not (fully) resolvable at startup, take the
+				// first complete observation as the reference.
+				if parent, err := readMdevParent(id); err == nil && parent.driver != "" {
+					parents[id] = parent
+					expected = parent
+				}
 			}
 
-			key := fmt.Sprintf("%s_%s", vgpuPrefix, dpi.deviceName)
-			if _, exists := envList[key]; !exists {
-				envList[key] = []string{}
+			err := checkMdevHealth(id, expected)
+			healthy := dp.state.health(id) == pluginapi.Healthy
+			if err != nil && healthy {
+				log.Printf("[%s] Marking vGPU unhealthy: %v", dp.deviceName, err)
+				dp.reportHealth(id, pluginapi.Unhealthy, err.Error())
+			} else if err == nil && !healthy {
+				log.Printf("[%s] Marking vGPU healthy: %s", dp.deviceName, id)
+				dp.reportHealth(id, pluginapi.Healthy, "")
 			}
-			envList[key] = append(envList[key], str)
-		}
-		deviceSpecs = append(deviceSpecs, &pluginapi.DeviceSpec{
-			HostPath:      vfioDevicePath,
-			ContainerPath: vfioDevicePath,
-			Permissions:   "mrw",
-		})
-		envs := buildEnv(envList)
-		log.Printf("Allocated devices: %s", envs)
-
-		response := pluginapi.ContainerAllocateResponse{
-			Envs:    envs,
-			Devices: deviceSpecs,
 		}
-
-		responses.ContainerResponses = append(responses.ContainerResponses, &response)
 	}
-	return &responses, nil
 }
 
-func (dpi *GenericVgpuDevicePlugin) GetPreferredAllocation(ctx context.Context, in *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	return nil, nil
+// mdevIommuGroup returns the IOMMU group vfio-mdev put the mdev in, after
+// checking that its VFIO group node exists.
+func mdevIommuGroup(devicePath string, uuid string) (string, error) {
+	group, err := readLink(devicePath, uuid, "iommu_group")
+	if err != nil {
+		return "", fmt.Errorf("vGPU %s has no IOMMU group: %v", uuid, err)
+	}
+	if _, err := os.Stat(filepath.Join(vfioGroupPath, group)); err != nil {
+		return "", fmt.Errorf("VFIO group %s of vGPU %s is not available: %v", group, uuid, err)
+	}
+	return group, nil
 }
 
-func (dpi *GenericVgpuDevicePlugin) PreStartContainer(ctx context.Context, in *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	res := &pluginapi.PreStartContainerResponse{}
-	return res, nil
+// mdevParent is the GPU an mdev was created on and the driver it is bound to.
+type mdevParent struct {
+	addr   string
+	driver string
 }
 
-// 健康检查todo：
-// 宿主机之外，通过echo "1" > uuid/remove 收不到删除的信号。
-func (dpi *GenericVgpuDevicePlugin) healthCheck() error {
-	watcher, err := fsnotify.NewWatcher()
+func readMdevParent(uuid string) (mdevParent, error) {
+	addr, err := readGpuIDFromVgpu(vGpuBasePath, uuid)
 	if err != nil {
-		log.Printf("unable to create fsnotify watcher: %v", err)
-		return err
+		return mdevParent{}, err
 	}
-	defer watcher.Close()
+	parent := mdevParent{addr: addr}
+	driver, err := os.Readlink(filepath.Join(basePciPath, addr, "driver"))
+	if err == nil {
+		parent.driver = filepath.Base(driver)
+	} else if !os.IsNotExist(err) {
+		return parent, err
+	}
+	return parent, nil
+}
 
-	err = watcher.Add(filepath.Dir(dpi.sockPath))
+// checkMdevHealth returns an error describing why the mdev can no longer be
+// handed to a VM, or nil if it is still usable.
+func checkMdevHealth(uuid string, expected mdevParent) error {
+	if _, err := os.Stat(filepath.Join(vGpuBasePath, uuid)); err != nil {
+		return fmt.Errorf("vGPU %s no longer exists: %v", uuid, err)
+	}
+	current, err := readMdevParent(uuid)
 	if err != nil {
-		log.Printf("unable to add device plugin socket path to fsnotify watcher: %v", err)
-		return err
+		return fmt.Errorf("unable to resolve parent GPU of vGPU %s: %v", uuid, err)
 	}
-
-	for {
-		select {
-		case <-dpi.stop:
-			return nil
-		case event := <-watcher.Events:
-			fmt.Printf("event name: %s, op: %v\n", event.Name, event.Op)
-		}
+	if _, err := os.Stat(filepath.Join(basePciPath, current.addr)); err != nil {
+		return fmt.Errorf("parent GPU %s of vGPU %s is gone: %v", current.addr, uuid, err)
+	}
+	if current.driver == "" {
+		return fmt.Errorf("parent GPU %s of vGPU %s is not bound to a driver", current.addr, uuid)
+	}
+	if expected.driver != "" && current.driver != expected.driver {
+		return fmt.Errorf("parent GPU %s of vGPU %s is bound to %s instead of %s", current.addr, uuid, current.driver, expected.driver)
 	}
+	return nil
 }
-
-// func (dpi *GenericVgpuDevicePlugin) healthCheck() error {
-// 	var health string
-// 	var path = dpi.devicePath
-// 	var pathVGPUDevice = make(map[string]string)
-
-// 	watcher, err := fsnotify.NewWatcher()
-// 	if err != nil {
-// 		log.Printf("unable to create fsnotify watcher: %v", err)
-// 		return err
-// 	}
-// 	defer watcher.Close()
-
-// 	err = watcher.Add(filepath.Dir(dpi.sockPath))
-// 	if err != nil {
-// 		log.Printf("unable to add device plugin socket path to fsnotify watcher: %v", err)
-// 		return err
-// 	}
-
-// 	_, err = os.Stat(path)
-// 	if err != nil {
-// 		if os.IsNotExist(err) {
-// 			log.Printf("unable to stat devie: %v", err)
-// 			return err
-// 		}
-// 	}
-
-// 	for _, dev := range dpi.devs {
-// 		devicePath := filepath.Join(path, dev.ID)
-// 		log.Printf("Adding watch for device path: %s", devicePath)
-// 		err = watcher.Add(devicePath)
-// 		pathVGPUDevice[devicePath] = dev.ID
-// 		if err != nil {
-// 			log.Printf("unable to add device path to fsnotify watcher: %v", err)
-// 			return err
-// 		}
-// 	}
-
-// 	for {
-// 		select {
-// 		case <-dpi.stop:
-// 			return nil
-// 		case event := <-watcher.Events:
-// 			v, ok := pathVGPUDevice[event.Name]
-// 			fmt.Printf("event name: %s, op: %v\n", event.Name, event.Op)
-// 			if ok {
-// 				if event.Op == fsnotify.Write {
-// 					log.Printf("Marking device unhealthy: %s", event.Name)
-// 					health = v
-// 					dpi.unhealthy <- health
-// 				}
-// 			}
-// 		}
-// 	}
-// }
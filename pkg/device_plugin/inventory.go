@@ -0,0 +1,374 @@
+package device_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Output formats of the list and inspect commands
+const (
+	OutputTable = "table"
+	OutputYAML  = "yaml"
+	OutputJSON  = "json"
+)
+
+var (
+	mdevUUIDReg   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	iommuGroupReg = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// gpuInfo is a PCI function as discovery sees it. Resource is the passthrough
+// resource it is advertised under, empty if it is not.
+type gpuInfo struct {
+	Address         string     `json:"address"`
+	Vendor          string     `json:"vendor"`
+	Device          string     `json:"device"`
+	Class           string     `json:"class"`
+	SubsystemVendor string     `json:"subsystemVendor,omitempty"`
+	SubsystemDevice string     `json:"subsystemDevice,omitempty"`
+	Driver          string     `json:"driver"`
+	IommuGroup      string     `json:"iommuGroup"`
+	NumaNode        int        `json:"numaNode"`
+	Resource        string     `json:"resource,omitempty"`
+	Mdevs           []mdevInfo `json:"mdevs,omitempty"`
+}
+
+// mdevInfo is a vGPU as discovery sees it.
+type mdevInfo struct {
+	UUID       string `json:"uuid"`
+	Parent     string `json:"parent"`
+	Type       string `json:"type"`
+	TypeDir    string `json:"typeDir"`
+	IommuGroup string `json:"iommuGroup,omitempty"`
+	Resource   string `json:"resource"`
+}
+
+// inventory is what the device maps would hold on this node, per GPU.
+type inventory struct {
+	resourceOfGroup map[string]string // key: advertised iommu_group value: resource name
+	passthrough     map[string]bool   // PCI functions advertised for passthrough
+	typeOf          map[string]string // key: vgpu uuid value: vGPU type
+	gpuVgpus        map[string][]string
+}
+
+// discoverInventory runs the discovery of the daemon without starting any
+// device plugin.
+func discoverInventory() *inventory {
+	iommus, devices, namespaces := discoverIommuDevices()
+	vgpus, gpuVgpus := discoverVgpus()
+
+	inv := &inventory{
+		resourceOfGroup: make(map[string]string),
+		passthrough:     make(map[string]bool),
+		typeOf:          make(map[string]string),
+		gpuVgpus:        gpuVgpus,
+	}
+	for name, groups := range devices {
+		for _, group := range groups {
+			inv.resourceOfGroup[group] = fmt.Sprintf("%s/%s", namespaces[name], name)
+		}
+	}
+	for _, devs := range iommus {
+		for _, dev := range devs {
+			inv.passthrough[dev.addr] = true
+		}
+	}
+	for mdevType, devs := range vgpus {
+		for _, dev := range devs {
+			inv.typeOf[dev.addr] = mdevType
+		}
+	}
+	return inv
+}
+
+// gpu describes the PCI function at addr with its vGPUs.
+func (inv *inventory) gpu(addr string) (gpuInfo, error) {
+	ids, err := readPciIDs(addr)
+	if err != nil {
+		return gpuInfo{}, fmt.Errorf("unable to read PCI device %s: %v", addr, err)
+	}
+	gpu := gpuInfo{
+		Address:         addr,
+		Vendor:          ids.vendor,
+		Device:          ids.device,
+		Class:           ids.class,
+		SubsystemVendor: ids.subsystemVendor,
+		SubsystemDevice: ids.subsystemDevice,
+		Driver:          currentPciDriver(addr),
+		NumaNode:        readNumaNode(addr),
+	}
+	if group, err := readLink(basePciPath, addr, "iommu_group"); err == nil {
+		gpu.IommuGroup = group
+		if inv.passthrough[addr] {
+			gpu.Resource = inv.resourceOfGroup[group]
+		}
+	}
+	uuids := append([]string(nil), inv.gpuVgpus[addr]...)
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		gpu.Mdevs = append(gpu.Mdevs, inv.mdev(uuid, addr))
+	}
+	return gpu, nil
+}
+
+func (inv *inventory) mdev(uuid string, parent string) mdevInfo {
+	mdev := mdevInfo{
+		UUID:     uuid,
+		Parent:   parent,
+		Type:     inv.typeOf[uuid],
+		Resource: fmt.Sprintf("%s/%s", DeviceNamespace, getConfig().mdevResourceName(inv.typeOf[uuid])),
+	}
+	mdev.TypeDir, _ = readLink(vGpuBasePath, uuid, "mdev_type")
+	mdev.IommuGroup, _ = readLink(vGpuBasePath, uuid, "iommu_group")
+	return mdev
+}
+
+// gpus describes every selected PCI function and every GPU carrying vGPUs,
+// ordered by address.
+func (inv *inventory) gpus() ([]gpuInfo, error) {
+	addrs, err := selectedPciDevices()
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	for _, addr := range addrs {
+		listed[addr] = true
+	}
+	for parent := range inv.gpuVgpus {
+		if parent != "" && !listed[parent] {
+			addrs = append(addrs, parent)
+		}
+	}
+	sort.Strings(addrs)
+
+	gpus := make([]gpuInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		gpu, err := inv.gpu(addr)
+		if err != nil {
+			return nil, err
+		}
+		gpus = append(gpus, gpu)
+	}
+	return gpus, nil
+}
+
+// PrintInventory writes every selected GPU and its vGPUs, as a table or as
+// JSON.
+func PrintInventory(w io.Writer, format string) error {
+	gpus, err := discoverInventory().gpus()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case OutputJSON:
+		return writeJSON(w, gpus)
+	case OutputTable:
+	default:
+		return fmt.Errorf("unknown output format %q, want %s or %s", format, OutputTable, OutputJSON)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tDEVICE\tDRIVER\tIOMMU GROUP\tNUMA\tRESOURCE")
+	for _, gpu := range gpus {
+		fmt.Fprintf(tw, "%s\t%s:%s\t%s\t%s\t%d\t%s\n", gpu.Address, gpu.Vendor, gpu.Device,
+			orDash(gpu.Driver), orDash(gpu.IommuGroup), gpu.NumaNode, orDash(gpu.Resource))
+		for _, mdev := range gpu.Mdevs {
+			fmt.Fprintf(tw, "  %s\t%s\t-\t%s\t%d\t%s\n", mdev.UUID, orDash(mdev.Type),
+				orDash(mdev.IommuGroup), gpu.NumaNode, mdev.Resource)
+		}
+	}
+	return tw.Flush()
+}
+
+// groupMember is a PCI function in an inspected IOMMU group.
+type groupMember struct {
+	Address string `json:"address"`
+	Driver  string `json:"driver"`
+}
+
+// mdevTypeInfo is a vGPU type a GPU supports.
+type mdevTypeInfo struct {
+	Dir                string   `json:"dir"`
+	Name               string   `json:"name"`
+	Resource           string   `json:"resource"`
+	AvailableInstances int      `json:"availableInstances"`
+	Instances          []string `json:"instances,omitempty"`
+}
+
+// pciDetail is the inspect output for a PCI function.
+type pciDetail struct {
+	gpuInfo
+	Selected          bool           `json:"selected"`
+	PassthroughDriver string         `json:"passthroughDriver,omitempty"`
+	DriverOverride    string         `json:"driverOverride,omitempty"`
+	GroupDevices      []groupMember  `json:"iommuGroupDevices,omitempty"`
+	MdevTypes         []mdevTypeInfo `json:"mdevTypes,omitempty"`
+	CdiDevice         string         `json:"cdiDevice,omitempty"`
+	VfioDevice        string         `json:"vfioDevice,omitempty"`
+}
+
+// mdevDetail is the inspect output for a vGPU.
+type mdevDetail struct {
+	mdevInfo
+	ParentDriver string `json:"parentDriver"`
+	Problem      string `json:"problem,omitempty"`
+	CdiDevice    string `json:"cdiDevice,omitempty"`
+	VfioDevice   string `json:"vfioDevice,omitempty"`
+}
+
+// groupDetail is the inspect output for an IOMMU group.
+type groupDetail struct {
+	IommuGroup string    `json:"iommuGroup"`
+	Resource   string    `json:"resource,omitempty"`
+	CdiDevice  string    `json:"cdiDevice,omitempty"`
+	VfioDevice string    `json:"vfioDevice,omitempty"`
+	Devices    []gpuInfo `json:"devices"`
+}
+
+// PrintInspect writes everything the daemon knows about a PCI function, a
+// vGPU or an IOMMU group, given by its address, UUID or number, as YAML or
+// JSON.
+func PrintInspect(w io.Writer, target string, format string) error {
+	if format != OutputYAML && format != OutputJSON {
+		return fmt.Errorf("unknown output format %q, want %s or %s", format, OutputYAML, OutputJSON)
+	}
+	inv := discoverInventory()
+	var detail interface{}
+	var err error
+	switch {
+	case pciAddrReg.MatchString(target):
+		detail, err = inv.inspectPci(target)
+	case mdevUUIDReg.MatchString(target):
+		detail, err = inv.inspectMdev(target)
+	case iommuGroupReg.MatchString(target):
+		detail, err = inv.inspectGroup(target)
+	default:
+		err = fmt.Errorf("%q is neither a PCI address, a vGPU UUID nor an IOMMU group", target)
+	}
+	if err != nil {
+		return err
+	}
+	if format == OutputJSON {
+		return writeJSON(w, detail)
+	}
+	data, err := yaml.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (inv *inventory) inspectPci(addr string) (*pciDetail, error) {
+	gpu, err := inv.gpu(addr)
+	if err != nil {
+		return nil, err
+	}
+	detail := &pciDetail{gpuInfo: gpu}
+	if match, ok := selectPciDevice(addr); ok {
+		detail.Selected = true
+		detail.PassthroughDriver = match.driver
+	}
+	if override, err := os.ReadFile(filepath.Join(basePciPath, addr, "driver_override")); err == nil {
+		if s := string(override); s != "(null)\n" && s != "\n" {
+			detail.DriverOverride = s[:len(s)-1]
+		}
+	}
+	if members, err := iommuGroupDevices(addr); err == nil {
+		for _, member := range members {
+			detail.GroupDevices = append(detail.GroupDevices, groupMember{Address: member, Driver: orDash(currentPciDriver(member))})
+		}
+	}
+	if types, err := readMdevTypes(addr); err == nil {
+		for _, t := range types {
+			available, _ := readMdevAvailableInstances(filepath.Join(basePciPath, addr, "mdev_supported_types", t.dir))
+			detail.MdevTypes = append(detail.MdevTypes, mdevTypeInfo{
+				Dir:                t.dir,
+				Name:               t.name,
+				Resource:           fmt.Sprintf("%s/%s", DeviceNamespace, getConfig().mdevResourceName(t.name)),
+				AvailableInstances: available,
+				Instances:          t.instances,
+			})
+		}
+	}
+	if gpu.Resource != "" {
+		detail.CdiDevice = cdiDeviceName(gpu.Resource, cdiClassGpu, gpu.IommuGroup)
+		detail.VfioDevice = vfioNode(gpu.IommuGroup)
+	}
+	return detail, nil
+}
+
+func (inv *inventory) inspectMdev(uuid string) (*mdevDetail, error) {
+	if _, ok := inv.typeOf[uuid]; !ok {
+		return nil, fmt.Errorf("vGPU %s not found", uuid)
+	}
+	parent, err := readMdevParent(uuid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve parent GPU of vGPU %s: %v", uuid, err)
+	}
+	detail := &mdevDetail{mdevInfo: inv.mdev(uuid, parent.addr), ParentDriver: orDash(parent.driver)}
+	if err := checkMdevHealth(uuid, mdevParent{}); err != nil {
+		detail.Problem = err.Error()
+	}
+	if detail.IommuGroup != "" {
+		detail.CdiDevice = cdiDeviceName(detail.Resource, cdiClassVgpu, uuid)
+		detail.VfioDevice = vfioNode(detail.IommuGroup)
+	}
+	return detail, nil
+}
+
+func (inv *inventory) inspectGroup(group string) (*groupDetail, error) {
+	entries, err := os.ReadDir(filepath.Join(iommuGroupBasePath, group, "devices"))
+	if err != nil {
+		return nil, fmt.Errorf("IOMMU group %s not found: %v", group, err)
+	}
+	detail := &groupDetail{IommuGroup: group, Resource: inv.resourceOfGroup[group], VfioDevice: vfioNode(group)}
+	if detail.Resource != "" {
+		detail.CdiDevice = cdiDeviceName(detail.Resource, cdiClassGpu, group)
+	}
+	for _, entry := range entries {
+		gpu, err := inv.gpu(entry.Name())
+		if err != nil {
+			continue
+		}
+		detail.Devices = append(detail.Devices, gpu)
+	}
+	return detail, nil
+}
+
+// cdiDeviceName returns the CDI name a device of the resource is described
+// under, e.g. xdxct.com/gpu=7.
+func cdiDeviceName(resource string, class string, id string) string {
+	namespace := filepath.Dir(resource)
+	return cdiDevices(cdiKind(namespace, class), []string{id})[0].Name
+}
+
+// vfioNode returns the VFIO group node of the group, empty if it does not exist.
+func vfioNode(group string) string {
+	path := filepath.Join(vfioGroupPath, group)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,117 @@
+package device_plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPrintInventory(t *testing.T) {
+	newTestHost(t)
+
+	var out bytes.Buffer
+	if err := PrintInventory(&out, OutputTable); err != nil {
+		t.Fatal(err)
+	}
+	want := `ADDRESS                                 DEVICE            DRIVER    IOMMU GROUP  NUMA  RESOURCE
+0000:3b:00.0                            1eed:1330         vfio-pci  7            0     xdxct.com/1330
+0000:3b:00.1                            1eed:1331         vfio-pci  7            0     xdxct.com/1330
+0000:3c:00.0                            1eed:1330         vfio-pci  8            1     xdxct.com/1330
+0000:3c:00.1                            1eed:1331         vfio-pci  8            1     xdxct.com/1330
+0000:5e:00.0                            1eed:1330         xdxgpu    20           1     -
+  9d5c5a1e-1b4a-4e0a-8a3e-000000000001  XGV_V0_1G_1_CORE  -         21           1     xdxct.com/XGV_V0_1G_1_CORE
+  9d5c5a1e-1b4a-4e0a-8a3e-000000000002  XGV_V0_1G_1_CORE  -         22           1     xdxct.com/XGV_V0_1G_1_CORE
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := PrintInventory(&out, OutputJSON); err != nil {
+		t.Fatal(err)
+	}
+	var gpus []gpuInfo
+	if err := json.Unmarshal(out.Bytes(), &gpus); err != nil {
+		t.Fatal(err)
+	}
+	if len(gpus) != 5 || gpus[4].Address != "0000:5e:00.0" || len(gpus[4].Mdevs) != 2 {
+		t.Fatalf("json = %s", out.String())
+	}
+	wantMdev := mdevInfo{
+		UUID:       "9d5c5a1e-1b4a-4e0a-8a3e-000000000001",
+		Parent:     "0000:5e:00.0",
+		Type:       "XGV_V0_1G_1_CORE",
+		TypeDir:    "xgv-XGV_V0_1G_1_CORE",
+		IommuGroup: "21",
+		Resource:   "xdxct.com/XGV_V0_1G_1_CORE",
+	}
+	if gpus[4].Mdevs[0] != wantMdev {
+		t.Errorf("mdev = %+v, want %+v", gpus[4].Mdevs[0], wantMdev)
+	}
+}
+
+func inspect(t *testing.T, target string) map[string]interface{} {
+	t.Helper()
+	var out bytes.Buffer
+	if err := PrintInspect(&out, target, OutputJSON); err != nil {
+		t.Fatal(err)
+	}
+	var detail map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &detail); err != nil {
+		t.Fatal(err)
+	}
+	return detail
+}
+
+func TestPrintInspect(t *testing.T) {
+	s := newTestHost(t)
+
+	pci := inspect(t, "0000:3b:00.0")
+	for field, want := range map[string]interface{}{
+		"resource":          "xdxct.com/1330",
+		"selected":          true,
+		"passthroughDriver": "vfio-pci",
+		"cdiDevice":         "xdxct.com/gpu=7",
+		"vfioDevice":        filepath.Join(s.cfg.Paths.VfioDevices, "7"),
+		"iommuGroupDevices": []interface{}{
+			map[string]interface{}{"address": "0000:3b:00.0", "driver": "vfio-pci"},
+			map[string]interface{}{"address": "0000:3b:00.1", "driver": "vfio-pci"},
+		},
+	} {
+		if !reflect.DeepEqual(pci[field], want) {
+			t.Errorf("inspect 0000:3b:00.0: %s = %v, want %v", field, pci[field], want)
+		}
+	}
+
+	parent := inspect(t, "0000:5e:00.0")
+	types, ok := parent["mdevTypes"].([]interface{})
+	if !ok || len(types) != 1 || types[0].(map[string]interface{})["availableInstances"] != 2.0 {
+		t.Errorf("inspect 0000:5e:00.0: mdevTypes = %v", parent["mdevTypes"])
+	}
+
+	mdev := inspect(t, "9d5c5a1e-1b4a-4e0a-8a3e-000000000002")
+	for field, want := range map[string]interface{}{
+		"parent":       "0000:5e:00.0",
+		"parentDriver": "xdxgpu",
+		"iommuGroup":   "22",
+		"cdiDevice":    "xdxct.com/vgpu=9d5c5a1e-1b4a-4e0a-8a3e-000000000002",
+	} {
+		if mdev[field] != want {
+			t.Errorf("inspect vGPU: %s = %v, want %v", field, mdev[field], want)
+		}
+	}
+	if problem, ok := mdev["problem"]; ok {
+		t.Errorf("inspect vGPU: healthy vGPU has problem %v", problem)
+	}
+
+	group := inspect(t, "8")
+	if group["resource"] != "xdxct.com/1330" || len(group["devices"].([]interface{})) != 2 {
+		t.Errorf("inspect 8 = %v", group)
+	}
+
+	if err := PrintInspect(&bytes.Buffer{}, "nonsense", OutputYAML); err == nil {
+		t.Error("inspect of an unknown target succeeded")
+	}
+}
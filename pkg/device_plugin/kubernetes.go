@@ -0,0 +1,53 @@
+package device_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// NodeNameEnv holds the name of the node the daemon runs on, set from
+// spec.nodeName through the downward API.
+const NodeNameEnv = "NODE_NAME"
+
+// newInClusterClient returns a client using the service account of the pod
+// and the name of the node it runs on.
+func newInClusterClient() (kubernetes.Interface, string, error) {
+	nodeName := os.Getenv(NodeNameEnv)
+	if nodeName == "" {
+		return nil, "", fmt.Errorf("%s is not set", NodeNameEnv)
+	}
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, nodeName, nil
+}
+
+// startKubernetesIntegrations sets up the node labeler and the event recorder
+// enabled in cfg. They run until rootCtx is canceled; the daemon keeps running
+// without them if there is no API access.
+func startKubernetesIntegrations(cfg *Config) {
+	if !cfg.NodeLabels && !cfg.Events {
+		return
+	}
+	client, nodeName, err := newInClusterClient()
+	if err != nil {
+		log.Printf("Not labeling the node or recording events: %v", err)
+		return
+	}
+	if cfg.Events {
+		startEventRecorder(client, nodeName)
+	}
+	if cfg.NodeLabels {
+		labeler := newNodeLabeler(client, nodeName)
+		goBackground(func() { labeler.run(rootCtx, nodeLabelsChanged) })
+	}
+}
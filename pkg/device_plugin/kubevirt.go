@@ -0,0 +1,256 @@
+package device_plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// permittedHostDevices is the permittedHostDevices block of the KubeVirt CR
+// configuration, limited to the fields the plugin fills in.
+type permittedHostDevices struct {
+	PciHostDevices  []pciHostDevice  `json:"pciHostDevices,omitempty"`
+	MediatedDevices []mediatedDevice `json:"mediatedDevices,omitempty"`
+}
+
+type pciHostDevice struct {
+	PciVendorSelector        string `json:"pciVendorSelector"`
+	ResourceName             string `json:"resourceName"`
+	ExternalResourceProvider bool   `json:"externalResourceProvider"`
+}
+
+type mediatedDevice struct {
+	MdevNameSelector         string `json:"mdevNameSelector"`
+	ResourceName             string `json:"resourceName"`
+	ExternalResourceProvider bool   `json:"externalResourceProvider"`
+}
+
+// kubeVirtCR is the part of a KubeVirt CR that is validated.
+type kubeVirtCR struct {
+	Spec struct {
+		Configuration struct {
+			PermittedHostDevices *permittedHostDevices `json:"permittedHostDevices"`
+		} `json:"configuration"`
+	} `json:"spec"`
+}
+
+// discoverPermittedHostDevices returns the entries KubeVirt needs for every
+// resource createDevicePlugins would register on this node: passthrough
+// resources by the vendor:device of the functions naming them, vGPU resources
+// by the mdev type directory of their vGPUs.
+func discoverPermittedHostDevices() *permittedHostDevices {
+	iommus, devices, namespaces := discoverIommuDevices()
+	vgpus, _ := discoverVgpus()
+
+	permitted := &permittedHostDevices{}
+	seen := make(map[string]bool)
+	for name, groups := range pciResources(devices) {
+		resourceName := fmt.Sprintf("%s/%s", namespaces[name], name)
+		for _, group := range groups {
+			for _, dev := range iommus[group] {
+				match, ok := selectPciDevice(dev.addr)
+				if !ok {
+					continue
+				}
+				ids, err := readPciIDs(dev.addr)
+				if err != nil || match.resourceName(ids.device) != name {
+					// e.g. the audio function of a GPU
+					continue
+				}
+				selector := fmt.Sprintf("%s:%s", ids.vendor, ids.device)
+				if seen[resourceName+"="+selector] {
+					continue
+				}
+				seen[resourceName+"="+selector] = true
+				permitted.PciHostDevices = append(permitted.PciHostDevices, pciHostDevice{
+					PciVendorSelector:        selector,
+					ResourceName:             resourceName,
+					ExternalResourceProvider: true,
+				})
+			}
+		}
+	}
+	for name, devs := range vgpuResources(vgpus) {
+		resourceName := fmt.Sprintf("%s/%s", DeviceNamespace, name)
+		for _, dev := range devs {
+			typeDir, err := readLink(vGpuBasePath, dev.addr, "mdev_type")
+			if err != nil || seen[resourceName+"="+typeDir] {
+				continue
+			}
+			seen[resourceName+"="+typeDir] = true
+			permitted.MediatedDevices = append(permitted.MediatedDevices, mediatedDevice{
+				MdevNameSelector:         typeDir,
+				ResourceName:             resourceName,
+				ExternalResourceProvider: true,
+			})
+		}
+	}
+
+	sort.Slice(permitted.PciHostDevices, func(i, j int) bool {
+		a, b := permitted.PciHostDevices[i], permitted.PciHostDevices[j]
+		if a.ResourceName != b.ResourceName {
+			return a.ResourceName < b.ResourceName
+		}
+		return a.PciVendorSelector < b.PciVendorSelector
+	})
+	sort.Slice(permitted.MediatedDevices, func(i, j int) bool {
+		a, b := permitted.MediatedDevices[i], permitted.MediatedDevices[j]
+		if a.ResourceName != b.ResourceName {
+			return a.ResourceName < b.ResourceName
+		}
+		return a.MdevNameSelector < b.MdevNameSelector
+	})
+	return permitted
+}
+
+// PrintPermittedHostDevices writes the permittedHostDevices block for the
+// devices on this node, to be placed under spec.configuration of the KubeVirt
+// CR.
+func PrintPermittedHostDevices(w io.Writer) error {
+	data, err := yaml.Marshal(map[string]*permittedHostDevices{
+		"permittedHostDevices": discoverPermittedHostDevices(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ValidatePermittedHostDevices checks the permittedHostDevices of the KubeVirt
+// CR in the file at path against the devices on this node, writes every
+// problem found to w and reports whether there were none.
+func ValidatePermittedHostDevices(path string, w io.Writer) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var cr kubeVirtCR
+	if err := yaml.Unmarshal(data, &cr); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	configured := cr.Spec.Configuration.PermittedHostDevices
+	if configured == nil {
+		configured = &permittedHostDevices{}
+	}
+
+	problems := checkPermittedHostDevices(discoverPermittedHostDevices(), configured)
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+	return len(problems) == 0, nil
+}
+
+// hostDeviceEntry is a pciHostDevices or mediatedDevices entry.
+type hostDeviceEntry struct {
+	selector     string
+	resourceName string
+	external     bool
+}
+
+// checkPermittedHostDevices compares the configured entries with the wanted
+// ones and describes every difference. PCI IDs are compared case-insensitively.
+func checkPermittedHostDevices(want *permittedHostDevices, configured *permittedHostDevices) []string {
+	var wantPci, havePci, wantMdev, haveMdev []hostDeviceEntry
+	for _, dev := range want.PciHostDevices {
+		wantPci = append(wantPci, hostDeviceEntry{strings.ToLower(dev.PciVendorSelector), dev.ResourceName, true})
+	}
+	for _, dev := range configured.PciHostDevices {
+		havePci = append(havePci, hostDeviceEntry{strings.ToLower(dev.PciVendorSelector), dev.ResourceName, dev.ExternalResourceProvider})
+	}
+	for _, dev := range want.MediatedDevices {
+		wantMdev = append(wantMdev, hostDeviceEntry{dev.MdevNameSelector, dev.ResourceName, true})
+	}
+	for _, dev := range configured.MediatedDevices {
+		haveMdev = append(haveMdev, hostDeviceEntry{dev.MdevNameSelector, dev.ResourceName, dev.ExternalResourceProvider})
+	}
+
+	namespaces := map[string]bool{DeviceNamespace: true}
+	for _, namespace := range getConfig().pciNamespaces() {
+		namespaces[namespace] = true
+	}
+	problems := checkHostDeviceEntries("pciHostDevices", "pciVendorSelector", wantPci, havePci, namespaces)
+	return append(problems, checkHostDeviceEntries("mediatedDevices", "mdevNameSelector", wantMdev, haveMdev, namespaces)...)
+}
+
+// checkHostDeviceEntries compares the entries of one list. Configured entries
+// for resources of other providers, i.e. outside the namespaces of the plugin
+// and with a selector the plugin does not advertise, are ignored.
+func checkHostDeviceEntries(list string, selectorField string, want []hostDeviceEntry, have []hostDeviceEntry, namespaces map[string]bool) []string {
+	wantSelectors := make(map[string][]string)
+	bySelector := make(map[string]string)
+	byFoldedName := make(map[string]string)
+	for _, entry := range want {
+		wantSelectors[entry.resourceName] = append(wantSelectors[entry.resourceName], entry.selector)
+		bySelector[entry.selector] = entry.resourceName
+		byFoldedName[strings.ToLower(entry.resourceName)] = entry.resourceName
+	}
+	haveSelectors := make(map[string][]string)
+	for _, entry := range have {
+		if _, ok := wantSelectors[entry.resourceName]; ok {
+			haveSelectors[entry.resourceName] = append(haveSelectors[entry.resourceName], entry.selector)
+		}
+	}
+
+	var problems []string
+	misspelled := make(map[string]bool)
+	for _, entry := range have {
+		if _, ok := wantSelectors[entry.resourceName]; ok {
+			if !entry.external {
+				problems = append(problems, fmt.Sprintf("%s: %s must set externalResourceProvider: true, it is provided by this plugin", list, entry.resourceName))
+			}
+			continue
+		}
+		namespace := strings.SplitN(entry.resourceName, "/", 2)[0]
+		name, ok := byFoldedName[strings.ToLower(entry.resourceName)]
+		if !ok {
+			name, ok = bySelector[entry.selector]
+		}
+		switch {
+		case ok && len(haveSelectors[name]) == 0:
+			misspelled[name] = true
+			problems = append(problems, fmt.Sprintf("%s: %s is misspelled, this node advertises %s %q as %s", list, entry.resourceName, selectorField, entry.selector, name))
+		case namespaces[namespace]:
+			problems = append(problems, fmt.Sprintf("%s: %s is not provided by this plugin on this node", list, entry.resourceName))
+		}
+	}
+
+	var names []string
+	for name := range wantSelectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		wanted, configured := wantSelectors[name], haveSelectors[name]
+		if len(configured) == 0 {
+			if !misspelled[name] {
+				problems = append(problems, fmt.Sprintf("%s: %s is missing, add %s %q", list, name, selectorField, strings.Join(wanted, `", "`)))
+			}
+			continue
+		}
+		for _, selector := range wanted {
+			if !containsString(configured, selector) {
+				problems = append(problems, fmt.Sprintf("%s: %s has no %s %q, which this node advertises it for", list, name, selectorField, selector))
+			}
+		}
+		for _, selector := range configured {
+			if !containsString(wanted, selector) {
+				problems = append(problems, fmt.Sprintf("%s: %s has %s %q, which this node does not advertise it for", list, name, selectorField, selector))
+			}
+		}
+	}
+	return problems
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
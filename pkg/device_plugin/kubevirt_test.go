@@ -0,0 +1,125 @@
+package device_plugin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newKubeVirtTestHost(t *testing.T) *fakeSysfs {
+	s := newTestHost(t)
+	s.cfg.ResourceNames = map[string]string{"1330": "Pangu_A0"}
+	SetConfig(s.cfg)
+	return s
+}
+
+func TestPrintPermittedHostDevices(t *testing.T) {
+	newKubeVirtTestHost(t)
+
+	var out bytes.Buffer
+	if err := PrintPermittedHostDevices(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `permittedHostDevices:
+  mediatedDevices:
+  - externalResourceProvider: true
+    mdevNameSelector: xgv-XGV_V0_1G_1_CORE
+    resourceName: xdxct.com/XGV_V0_1G_1_CORE
+  pciHostDevices:
+  - externalResourceProvider: true
+    pciVendorSelector: 1eed:1330
+    resourceName: xdxct.com/Pangu_A0
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func validateKubeVirtCR(t *testing.T, cr string) (bool, []string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kubevirt.yaml")
+	if err := os.WriteFile(path, []byte(cr), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ok, err := ValidatePermittedHostDevices(path, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var problems []string
+	if out.Len() > 0 {
+		problems = strings.Split(strings.TrimSpace(out.String()), "\n")
+	}
+	return ok, problems
+}
+
+func TestValidatePermittedHostDevices(t *testing.T) {
+	newKubeVirtTestHost(t)
+
+	ok, problems := validateKubeVirtCR(t, `apiVersion: kubevirt.io/v1
+kind: KubeVirt
+spec:
+  configuration:
+    permittedHostDevices:
+      pciHostDevices:
+      - pciVendorSelector: "1EED:1330"
+        resourceName: xdxct.com/Pangu_A0
+        externalResourceProvider: true
+      - pciVendorSelector: "10de:1eb8"
+        resourceName: nvidia.com/TU104GL_Tesla_T4
+      mediatedDevices:
+      - mdevNameSelector: xgv-XGV_V0_1G_1_CORE
+        resourceName: xdxct.com/XGV_V0_1G_1_CORE
+        externalResourceProvider: true
+`)
+	if !ok || problems != nil {
+		t.Errorf("matching CR reported %v", problems)
+	}
+
+	ok, problems = validateKubeVirtCR(t, `apiVersion: kubevirt.io/v1
+kind: KubeVirt
+spec:
+  configuration:
+    permittedHostDevices:
+      pciHostDevices:
+      - pciVendorSelector: "1eed:1330"
+        resourceName: xdxct.com/pangu_a0
+        externalResourceProvider: true
+      mediatedDevices:
+      - mdevNameSelector: xgv-XGV_V0_1G_1_CORE
+        resourceName: xdxct.com/XGV_V0_1G_1_CORE
+      - mdevNameSelector: xgv-XGV_V0_128M_1_CORE
+        resourceName: xdxct.com/XGV_V0_128M_1_CORE
+        externalResourceProvider: true
+`)
+	want := []string{
+		`pciHostDevices: xdxct.com/pangu_a0 is misspelled, this node advertises pciVendorSelector "1eed:1330" as xdxct.com/Pangu_A0`,
+		`mediatedDevices: xdxct.com/XGV_V0_1G_1_CORE must set externalResourceProvider: true, it is provided by this plugin`,
+		`mediatedDevices: xdxct.com/XGV_V0_128M_1_CORE is not provided by this plugin on this node`,
+	}
+	if ok || !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems = %q, want %q", problems, want)
+	}
+
+	ok, problems = validateKubeVirtCR(t, `apiVersion: kubevirt.io/v1
+kind: KubeVirt
+spec:
+  configuration:
+    permittedHostDevices:
+      pciHostDevices:
+      - pciVendorSelector: "1eed:1331"
+        resourceName: xdxct.com/Pangu_A0
+        externalResourceProvider: true
+`)
+	want = []string{
+		`pciHostDevices: xdxct.com/Pangu_A0 has no pciVendorSelector "1eed:1330", which this node advertises it for`,
+		`pciHostDevices: xdxct.com/Pangu_A0 has pciVendorSelector "1eed:1331", which this node does not advertise it for`,
+		`mediatedDevices: xdxct.com/XGV_V0_1G_1_CORE is missing, add mdevNameSelector "xgv-XGV_V0_1G_1_CORE"`,
+	}
+	if ok || !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems = %q, want %q", problems, want)
+	}
+}
@@ -0,0 +1,257 @@
+package device_plugin
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mdevLayoutEnv holds the desired vGPU layout when the configuration file does
+// not set one, one parent GPU per line (or separated by ';'), e.g.
+//
+//	0000:3b:00.0: 4x XGV_V0_1G_1_CORE
+//	0000:3c:00.0: 2x XGV_V0_1G_1_CORE, 8x XGV_V0_128M_1_CORE
+//
+// Parent GPUs that are not listed are left untouched. For listed parents the
+// instances of every supported type are created or removed to match the layout,
+// types that are not mentioned are scaled down to zero.
+const mdevLayoutEnv = "XDXCT_MDEV_LAYOUT"
+
+var (
+	mdevLayoutEntryReg = regexp.MustCompile(`^([0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7])\s*:\s*(.*)$`)
+	mdevLayoutCountReg = regexp.MustCompile(`^(\d+)\s*x\s*(\w+)$`)
+)
+
+// mdevLayout key: parent GPU pci address value: key: vGPU type value: number of instances
+type mdevLayout map[string]map[string]int
+
+// mdevType describes one entry of a parent GPU's mdev_supported_types directory.
+type mdevType struct {
+	dir       string // sysfs directory name, e.g. xgv-XGV_V0_1G_1_CORE
+	name      string // vGPU type as advertised by the device plugin
+	instances []string
+}
+
+func parseMdevLayout(text string) (mdevLayout, error) {
+	layout := make(mdevLayout)
+	entries := strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\n' || r == ';'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		matches := mdevLayoutEntryReg.FindStringSubmatch(entry)
+		if matches == nil {
+			return nil, fmt.Errorf("invalid mdev layout entry %q, expected \"<pci-addr>: <count>x <type>[, ...]\"", entry)
+		}
+		parent := strings.ToLower(matches[1])
+		if _, exists := layout[parent]; exists {
+			return nil, fmt.Errorf("parent GPU %s is listed more than once in the mdev layout", parent)
+		}
+		types := make(map[string]int)
+		for _, item := range strings.Split(matches[2], ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			counts := mdevLayoutCountReg.FindStringSubmatch(item)
+			if counts == nil {
+				return nil, fmt.Errorf("invalid vGPU count %q for parent GPU %s, expected \"<count>x <type>\"", item, parent)
+			}
+			count, err := strconv.Atoi(counts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid vGPU count %q for parent GPU %s: %v", item, parent, err)
+			}
+			types[counts[2]] += count
+		}
+		layout[parent] = types
+	}
+	return layout, nil
+}
+
+// applyMdevLayout reconciles every parent GPU in the layout and reports all
+// parents that could not be brought to the desired state. vGPUs kubelet
+// assigned to a container are never removed: removing a vGPU bound to vfio
+// blocks until QEMU releases it and pulls it out of the running VM.
+func applyMdevLayout(layout mdevLayout) error {
+	assigned, err := assignedMdevs()
+	if err != nil {
+		log.Printf("Unable to get the vGPUs assigned to VMs from kubelet, no vGPU will be removed: %v", err)
+	}
+	var failures []string
+	for parent, want := range layout {
+		if err := reconcileParentMdevs(parent, want, assigned); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// reconcileParentMdevs creates and removes the vGPUs of one parent GPU until it
+// matches want. Only the vGPUs not in assigned are removed, if assigned is nil
+// none are. The change is not atomic. Unsupported types, assigned vGPUs in the
+// way and, when nothing has to be removed, a lack of room are found before
+// anything is written. The room removals free is only known after them, and a
+// create may still fail, so either leaves the parent between the two layouts.
+func reconcileParentMdevs(parent string, want map[string]int, assigned map[string]bool) error {
+	types, err := readMdevTypes(parent)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]mdevType, len(types))
+	for _, t := range types {
+		byName[t.name] = t
+	}
+	for name := range want {
+		if _, ok := byName[name]; !ok {
+			return fmt.Errorf("parent GPU %s does not support vGPU type %s", parent, name)
+		}
+	}
+
+	var remove []string
+	for _, t := range types {
+		extra := len(t.instances) - want[t.name]
+		for i := len(t.instances) - 1; i >= 0 && extra > 0; i-- {
+			if uuid := t.instances[i]; assigned != nil && !assigned[uuid] {
+				remove = append(remove, uuid)
+				extra--
+			}
+		}
+		if extra > 0 && assigned == nil {
+			return fmt.Errorf("parent GPU %s has %d %s vGPUs, %d requested, and kubelet cannot tell which are assigned to VMs", parent, len(t.instances), t.name, want[t.name])
+		}
+		if extra > 0 {
+			return fmt.Errorf("parent GPU %s has %d %s vGPUs assigned to VMs, %d requested", parent, want[t.name]+extra, t.name, want[t.name])
+		}
+	}
+
+	type creation struct {
+		t        mdevType
+		typePath string
+		missing  int
+	}
+	var create []creation
+	for _, t := range types {
+		missing := want[t.name] - len(t.instances)
+		if missing <= 0 {
+			continue
+		}
+		typePath := filepath.Join(basePciPath, parent, "mdev_supported_types", t.dir)
+		available, err := readMdevAvailableInstances(typePath)
+		if err != nil {
+			return fmt.Errorf("failed to read available instances of %s on %s: %v", t.name, parent, err)
+		}
+		if available < missing && len(remove) == 0 {
+			return fmt.Errorf("parent GPU %s has room for %d more %s vGPUs, %d requested", parent, available, t.name, missing)
+		}
+		create = append(create, creation{t: t, typePath: typePath, missing: missing})
+	}
+
+	// remove first, instances of one type usually share capacity with the others
+	for _, uuid := range remove {
+		log.Printf("Removing vGPU %s from %s", uuid, parent)
+		if err := writeSysfs(filepath.Join(vGpuBasePath, uuid, "remove"), "1"); err != nil {
+			return fmt.Errorf("failed to remove vGPU %s from %s: %v", uuid, parent, err)
+		}
+	}
+
+	for _, c := range create {
+		if len(remove) > 0 {
+			available, err := readMdevAvailableInstances(c.typePath)
+			if err != nil {
+				return fmt.Errorf("failed to read available instances of %s on %s: %v", c.t.name, parent, err)
+			}
+			if available < c.missing {
+				return fmt.Errorf("parent GPU %s has room for %d more %s vGPUs after removing %d vGPUs, %d requested", parent, available, c.t.name, len(remove), c.missing)
+			}
+		}
+		for i := 0; i < c.missing; i++ {
+			uuid, err := newMdevUUID()
+			if err != nil {
+				return err
+			}
+			log.Printf("Creating vGPU %s (%s) on %s", uuid, c.t.name, parent)
+			if err := writeSysfs(filepath.Join(c.typePath, "create"), uuid); err != nil {
+				return fmt.Errorf("failed to create %s vGPU on %s: %v", c.t.name, parent, err)
+			}
+		}
+	}
+	return nil
+}
+
+// assignedMdevs returns the vGPUs kubelet assigned to containers. vGPUs are
+// identified by UUID, so the resource they are advertised under does not matter.
+func assignedMdevs() (map[string]bool, error) {
+	allocated, err := allocatedDevices()
+	if err != nil {
+		return nil, err
+	}
+	assigned := make(map[string]bool)
+	for _, ids := range allocated {
+		for id := range ids {
+			assigned[id] = true
+		}
+	}
+	return assigned, nil
+}
+
+// readMdevTypes lists the vGPU types a parent GPU supports together with the
+// mdevs that currently exist for each of them.
+func readMdevTypes(parent string) ([]mdevType, error) {
+	typesPath := filepath.Join(basePciPath, parent, "mdev_supported_types")
+	entries, err := os.ReadDir(typesPath)
+	if err != nil {
+		return nil, fmt.Errorf("parent GPU %s does not support mediated devices: %v", parent, err)
+	}
+
+	var types []mdevType
+	for _, entry := range entries {
+		name, err := readVgpuIDFromFile(typesPath, entry.Name(), "name")
+		if err != nil || name == "" {
+			log.Printf("Could not get vgpu type name of %s on %s", entry.Name(), parent)
+			continue
+		}
+		t := mdevType{dir: entry.Name(), name: name}
+		devices, err := os.ReadDir(filepath.Join(typesPath, entry.Name(), "devices"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to list %s vGPUs on %s: %v", name, parent, err)
+		}
+		for _, dev := range devices {
+			t.instances = append(t.instances, dev.Name())
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+func readMdevAvailableInstances(typePath string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(typePath, "available_instances"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// newMdevUUID returns a random (version 4) UUID to name a new mdev.
+func newMdevUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate vGPU uuid: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
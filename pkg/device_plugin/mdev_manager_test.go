@@ -0,0 +1,191 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	testVgpu1 = "9d5c5a1e-1b4a-4e0a-8a3e-000000000001"
+	testVgpu2 = "9d5c5a1e-1b4a-4e0a-8a3e-000000000002"
+)
+
+// mdevsOf returns the vGPUs of the parent GPU in the fake sysfs.
+func mdevsOf(t *testing.T, parent string, typeDir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(basePciPath, parent, "mdev_supported_types", typeDir, "devices"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uuids []string
+	for _, entry := range entries {
+		uuids = append(uuids, entry.Name())
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+// assignVgpu makes kubelet report the vGPU as assigned to a VM.
+func assignVgpu(t *testing.T, uuid string) {
+	newFakePodResources(t, &podresourcesapi.PodResources{
+		Name: "virt-launcher-vm1",
+		Containers: []*podresourcesapi.ContainerResources{{
+			Name:    "compute",
+			Devices: []*podresourcesapi.ContainerDevices{{ResourceName: "xdxct.com/XGV_V0_1G_1_CORE", DeviceIds: []string{uuid}}},
+		}},
+	})
+}
+
+func TestMdevLayoutKeepsAssignedVgpus(t *testing.T) {
+	newTestHost(t)
+	assignVgpu(t, testVgpu1)
+
+	// the unassigned vGPU goes, although it comes last
+	if err := applyMdevLayout(mdevLayout{"0000:5e:00.0": {"XGV_V0_1G_1_CORE": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mdevsOf(t, "0000:5e:00.0", "xgv-XGV_V0_1G_1_CORE"); len(got) != 1 || got[0] != testVgpu1 {
+		t.Fatalf("vGPUs = %v, want [%s]", got, testVgpu1)
+	}
+
+	err := applyMdevLayout(mdevLayout{"0000:5e:00.0": {}})
+	if err == nil || !strings.Contains(err.Error(), "0000:5e:00.0") || !strings.Contains(err.Error(), "assigned to VMs") {
+		t.Errorf("err = %v, want the parent with vGPUs assigned to VMs", err)
+	}
+	if got := mdevsOf(t, "0000:5e:00.0", "xgv-XGV_V0_1G_1_CORE"); len(got) != 1 {
+		t.Errorf("vGPUs = %v, the assigned vGPU was removed", got)
+	}
+}
+
+func TestMdevLayoutWithoutKubeletRemovesNothing(t *testing.T) {
+	s := newTestHost(t)
+
+	err := applyMdevLayout(mdevLayout{"0000:5e:00.0": {"XGV_V0_1G_1_CORE": 1}})
+	if err == nil || !strings.Contains(err.Error(), "0000:5e:00.0") {
+		t.Errorf("err = %v, want an error naming the parent", err)
+	}
+	if got := mdevsOf(t, "0000:5e:00.0", "xgv-XGV_V0_1G_1_CORE"); len(got) != 2 {
+		t.Errorf("vGPUs = %v, want both", got)
+	}
+	if writes := s.sysfsWrites(); len(writes) != 0 {
+		t.Errorf("sysfs written: %v", writes)
+	}
+}
+
+func TestParseMdevLayout(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    mdevLayout
+		wantErr string
+	}{
+		{
+			text: "0000:3B:00.0: 4x XGV_V0_1G_1_CORE\n# comment\n0000:3c:00.0: 2x XGV_V0_1G_1_CORE, 8 x XGV_V0_128M_1_CORE",
+			want: mdevLayout{
+				"0000:3b:00.0": {"XGV_V0_1G_1_CORE": 4},
+				"0000:3c:00.0": {"XGV_V0_1G_1_CORE": 2, "XGV_V0_128M_1_CORE": 8},
+			},
+		},
+		{
+			text: "0000:3b:00.0: 1x XGV_V0_1G_1_CORE, 2x XGV_V0_1G_1_CORE; 0000:3c:00.0:",
+			want: mdevLayout{"0000:3b:00.0": {"XGV_V0_1G_1_CORE": 3}, "0000:3c:00.0": {}},
+		},
+		{text: "", want: mdevLayout{}},
+		{text: "3b:00.0: 4x XGV_V0_1G_1_CORE", wantErr: "invalid mdev layout entry"},
+		{text: "0000:3b:00.0: four XGV_V0_1G_1_CORE", wantErr: "invalid vGPU count"},
+		{text: "0000:3b:00.0: 1x A; 0000:3B:00.0: 2x A", wantErr: "more than once"},
+	}
+	for _, tt := range tests {
+		got, err := parseMdevLayout(tt.text)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseMdevLayout(%q) error = %v, want %q", tt.text, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMdevLayout(%q) error = %v", tt.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMdevLayout(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestApplyMdevLayout(t *testing.T) {
+	s := newTestHost(t)
+	newFakePodResources(t)
+	const parent, small = "0000:5e:00.0", "xgv-XGV_V0_128M_1_CORE"
+	s.addMdevType(parent, small, "XGV_V0_128M_1_CORE", 4)
+	s.addMdev(parent, small, "9d5c5a1e-1b4a-4e0a-8a3e-000000000010", "40")
+
+	// two more up to available_instances, the unlisted type goes
+	if err := applyMdevLayout(mdevLayout{parent: {"XGV_V0_1G_1_CORE": 4}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mdevsOf(t, parent, "xgv-XGV_V0_1G_1_CORE"); len(got) != 4 {
+		t.Errorf("XGV_V0_1G_1_CORE vGPUs = %v, want 4", got)
+	}
+	if got := mdevsOf(t, parent, small); len(got) != 0 {
+		t.Errorf("XGV_V0_128M_1_CORE vGPUs = %v, want none", got)
+	}
+
+	writes := len(s.sysfsWrites())
+	for layout, wantErr := range map[string]string{
+		parent + ": 5x XGV_V0_1G_1_CORE":    "room for 0 more",
+		parent + ": 1x XGV_V0_512M_1_CORE":  "does not support vGPU type XGV_V0_512M_1_CORE",
+		"0000:3b:00.0: 1x XGV_V0_1G_1_CORE": "0000:3b:00.0 does not support mediated devices",
+	} {
+		parsed, err := parseMdevLayout(layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := applyMdevLayout(parsed); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("applyMdevLayout(%s) error = %v, want %q", layout, err, wantErr)
+		}
+	}
+	if got := s.sysfsWrites(); len(got) != writes {
+		t.Errorf("failed layouts wrote to sysfs: %v", got[writes:])
+	}
+	if got := mdevsOf(t, parent, "xgv-XGV_V0_1G_1_CORE"); len(got) != 4 {
+		t.Errorf("XGV_V0_1G_1_CORE vGPUs = %v after failed layouts, want 4", got)
+	}
+}
+
+func TestMdevLayoutShortfallWrites(t *testing.T) {
+	s := newTestHost(t)
+	newFakePodResources(t)
+	const parent, small, large = "0000:5e:00.0", "xgv-XGV_V0_128M_1_CORE", "xgv-XGV_V0_2G_1_CORE"
+	const smallVgpu = "9d5c5a1e-1b4a-4e0a-8a3e-000000000010"
+	s.addMdevType(parent, large, "XGV_V0_2G_1_CORE", 0)
+
+	// the 1G vGPUs fit, the 2G one does not: nothing is created
+	err := applyMdevLayout(mdevLayout{parent: {"XGV_V0_1G_1_CORE": 4, "XGV_V0_2G_1_CORE": 1}})
+	if err == nil || !strings.Contains(err.Error(), "room for 0 more XGV_V0_2G_1_CORE vGPUs") {
+		t.Errorf("err = %v, want no room for XGV_V0_2G_1_CORE", err)
+	}
+	if got := s.sysfsWrites(); len(got) != 0 {
+		t.Errorf("sysfs writes = %v, want none", got)
+	}
+
+	// the room removing the 128M vGPU frees is only known after removing it
+	s.addMdevType(parent, small, "XGV_V0_128M_1_CORE", 4)
+	s.addMdev(parent, small, smallVgpu, "40")
+	err = applyMdevLayout(mdevLayout{parent: {"XGV_V0_1G_1_CORE": 5}})
+	if err == nil || !strings.Contains(err.Error(), "room for 2 more XGV_V0_1G_1_CORE vGPUs after removing 1 vGPUs, 3 requested") {
+		t.Errorf("err = %v, want no room after the removal", err)
+	}
+	want := []string{"sys/bus/mdev/devices/" + smallVgpu + "/remove=1"}
+	if got := s.sysfsWrites(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sysfs writes = %v, want %v", got, want)
+	}
+	if got := mdevsOf(t, parent, "xgv-XGV_V0_1G_1_CORE"); len(got) != 2 {
+		t.Errorf("XGV_V0_1G_1_CORE vGPUs = %v, want the 2 there were", got)
+	}
+}
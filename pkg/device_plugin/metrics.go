@@ -0,0 +1,264 @@
+package device_plugin
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const metricsNamespace = "xdxct_device_plugin"
+
+var (
+	allocateRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "allocate_requests_total",
+		Help:      "Allocate calls received from kubelet.",
+	}, []string{"resource"})
+	allocateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "allocate_failures_total",
+		Help:      "Allocate calls that were rejected.",
+	}, []string{"resource"})
+	reregistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reregistrations_total",
+		Help:      "Restarts and re-registrations with kubelet after the plugin socket was removed.",
+	}, []string{"resource"})
+	discoveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_duration_seconds",
+		Help:      "Time taken to scan sysfs for devices.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"bus"})
+)
+
+var (
+	devicesDesc = prometheus.NewDesc(metricsNamespace+"_devices",
+		"Devices advertised to kubelet.", []string{"resource"}, nil)
+	healthyDevicesDesc = prometheus.NewDesc(metricsNamespace+"_healthy_devices",
+		"Advertised devices that are healthy.", []string{"resource"}, nil)
+	unhealthyDevicesDesc = prometheus.NewDesc(metricsNamespace+"_unhealthy_devices",
+		"Advertised devices that are unhealthy.", []string{"resource"}, nil)
+	allocatedDevicesDesc = prometheus.NewDesc(metricsNamespace+"_allocated_devices",
+		"Advertised devices assigned to a running container according to the kubelet pod resources API.", []string{"resource"}, nil)
+	registeredDesc = prometheus.NewDesc(metricsNamespace+"_registered",
+		"1 if the device plugin is registered with kubelet, 0 while registration is being retried.", []string{"resource"}, nil)
+	deviceHealthyDesc = prometheus.NewDesc(metricsNamespace+"_device_healthy",
+		"1 if the device is healthy, 0 otherwise. The device is an IOMMU group for passthrough GPUs and an mdev UUID for vGPUs.",
+		[]string{"resource", "device", "parent_gpu"}, nil)
+)
+
+// metricsRegistry holds the plugin metrics, kept apart from the global
+// registry so only what is registered here is exposed.
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		allocateRequests,
+		allocateFailures,
+		reregistrations,
+		discoveryDuration,
+		newDeviceCollector(),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// observeDiscovery records the duration of a sysfs scan started at start.
+func observeDiscovery(bus string, start time.Time) {
+	discoveryDuration.WithLabelValues(bus).Observe(time.Since(start).Seconds())
+}
+
+// podResourcesTimeout bounds the kubelet queries made for scrapes and events.
+const podResourcesTimeout = 5 * time.Second
+
+// allocationsTTL is how long scrapes reuse the allocations last read from
+// kubelet before a new read is started.
+var allocationsTTL = 15 * time.Second
+
+// deviceCollector reports the inventory of the running device plugins at
+// scrape time, so the gauges never lag behind rediscovery or health changes.
+// Only the allocations come from a cache, as they need a kubelet query.
+type deviceCollector struct {
+	allocations *allocationCache
+}
+
+func newDeviceCollector() deviceCollector {
+	return deviceCollector{allocations: &allocationCache{}}
+}
+
+func (deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- devicesDesc
+	ch <- healthyDevicesDesc
+	ch <- unhealthyDevicesDesc
+	ch <- allocatedDevicesDesc
+	ch <- registeredDesc
+	ch <- deviceHealthyDesc
+}
+
+func (c deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	allocated := c.allocations.get()
+
+	iommus := getIommuMap()
+	collectPlugins(ch, snapshotPlugins(&pciPluginsLock, pciPlugins), allocated, func(group string) string {
+		if devs := iommus[group]; len(devs) > 0 {
+			return devs[0].addr
+		}
+		return ""
+	})
+	parents := vgpuParents(getGpuVgpuMap())
+	collectPlugins(ch, snapshotPlugins(&vgpuPluginsLock, vgpuPlugins), allocated, func(uuid string) string {
+		return parents[uuid]
+	})
+}
+
+// allocationCache holds the allocations last read from kubelet, so a slow or
+// stopped kubelet does not hold up every scrape.
+type allocationCache struct {
+	lock       sync.Mutex
+	allocated  map[string]map[string]bool
+	read       time.Time
+	refreshing bool
+}
+
+// get returns the cached allocations, nil if the last read failed, and starts
+// a read in the background once they are older than allocationsTTL.
+func (c *allocationCache) get() map[string]map[string]bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.refreshing && time.Since(c.read) >= allocationsTTL {
+		c.refreshing = true
+		go c.refresh()
+	}
+	return c.allocated
+}
+
+func (c *allocationCache) refresh() {
+	allocated, err := allocatedDevices()
+	if err != nil {
+		log.Printf("Unable to get allocated devices from kubelet: %v", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.allocated = allocated
+	c.read = time.Now()
+	c.refreshing = false
+}
+
+func collectPlugins(ch chan<- prometheus.Metric, plugins map[string]pluginSnapshot, allocated map[string]map[string]bool, parentOf func(id string) string) {
+	for deviceName, plugin := range plugins {
+		devs := plugin.devs
+		healthy, unhealthy, inUse := 0, 0, 0
+		for _, dev := range devs {
+			value := 0.0
+			if dev.Health == pluginapi.Healthy {
+				healthy++
+				value = 1
+			} else {
+				unhealthy++
+			}
+			if allocated[plugin.resourceName][dev.ID] {
+				inUse++
+			}
+			ch <- prometheus.MustNewConstMetric(deviceHealthyDesc, prometheus.GaugeValue, value, deviceName, dev.ID, parentOf(dev.ID))
+		}
+		registered := 0.0
+		if plugin.registered {
+			registered = 1
+		}
+		ch <- prometheus.MustNewConstMetric(registeredDesc, prometheus.GaugeValue, registered, deviceName)
+		ch <- prometheus.MustNewConstMetric(devicesDesc, prometheus.GaugeValue, float64(len(devs)), deviceName)
+		ch <- prometheus.MustNewConstMetric(healthyDevicesDesc, prometheus.GaugeValue, float64(healthy), deviceName)
+		ch <- prometheus.MustNewConstMetric(unhealthyDevicesDesc, prometheus.GaugeValue, float64(unhealthy), deviceName)
+		if allocated != nil {
+			ch <- prometheus.MustNewConstMetric(allocatedDevicesDesc, prometheus.GaugeValue, float64(inUse), deviceName)
+		}
+	}
+}
+
+type pluginSnapshot struct {
+	resourceName string
+	devs         []*pluginapi.Device
+	registered   bool
+}
+
+// snapshotPlugins copies the state of every plugin in the registry.
+func snapshotPlugins(lock sync.Locker, plugins map[string]*GenericDevicePlugin) map[string]pluginSnapshot {
+	lock.Lock()
+	defer lock.Unlock()
+	snapshot := make(map[string]pluginSnapshot, len(plugins))
+	for deviceName, dp := range plugins {
+		snapshot[deviceName] = pluginSnapshot{resourceName: dp.resourceName(), devs: dp.devices(), registered: dp.isRegistered()}
+	}
+	return snapshot
+}
+
+// allocatedDevices asks kubelet which of our devices are assigned to running
+// containers. Kubelet never tells a device plugin when a device is released,
+// so this is the only reliable source. The result is keyed by resource name,
+// including the namespace, then by device ID.
+func allocatedDevices() (map[string]map[string]bool, error) {
+	resp, err := listPodResources()
+	if err != nil {
+		return nil, err
+	}
+
+	allocated := make(map[string]map[string]bool)
+	for _, pod := range resp.PodResources {
+		for _, container := range pod.Containers {
+			for _, dev := range container.Devices {
+				if allocated[dev.ResourceName] == nil {
+					allocated[dev.ResourceName] = make(map[string]bool)
+				}
+				for _, id := range dev.DeviceIds {
+					allocated[dev.ResourceName][id] = true
+				}
+			}
+		}
+	}
+	return allocated, nil
+}
+
+// listPodResources asks kubelet for the devices assigned to every container.
+func listPodResources() (*podresourcesapi.ListPodResourcesResponse, error) {
+	socket := filepath.Join(getConfig().Paths.PodResources, "kubelet.sock")
+	conn, err := connect(socket, podResourcesTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), podResourcesTimeout)
+	defer cancel()
+	return podresourcesapi.NewPodResourcesListerClient(conn).List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+}
+
+// serveHTTP serves /metrics and the /healthz and /readyz probes on addr until
+// stop is closed.
+func serveHTTP(addr string, stop <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.Handle("/healthz", probeHandler(checkLive))
+	mux.Handle("/readyz", probeHandler(checkReady))
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-stop
+		server.Close()
+	}()
+
+	log.Printf("Serving metrics and probes on %s", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("HTTP server on %s failed: %v", addr, err)
+	}
+}
@@ -0,0 +1,197 @@
+package device_plugin
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// fakePodResources serves the kubelet pod resources List call.
+type fakePodResources struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	pods    []*podresourcesapi.PodResources
+	release <-chan struct{} // if set, List answers once it is closed
+}
+
+func newFakePodResources(t *testing.T, pods ...*podresourcesapi.PodResources) {
+	t.Helper()
+	serveFakePodResources(t, &fakePodResources{pods: pods})
+}
+
+// newSlowPodResources is newFakePodResources answering only once the returned
+// channel is closed.
+func newSlowPodResources(t *testing.T, pods ...*podresourcesapi.PodResources) chan struct{} {
+	t.Helper()
+	release := make(chan struct{})
+	serveFakePodResources(t, &fakePodResources{pods: pods, release: release})
+	return release
+}
+
+func serveFakePodResources(t *testing.T, f *fakePodResources) {
+	t.Helper()
+	sock, err := net.Listen("unix", filepath.Join(getConfig().Paths.PodResources, "kubelet.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, f)
+	go server.Serve(sock)
+	t.Cleanup(server.Stop)
+}
+
+func (f *fakePodResources) List(ctx context.Context, req *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: f.pods}, nil
+}
+
+func TestDeviceCollector(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	newFakePodResources(t, &podresourcesapi.PodResources{
+		Name: "virt-launcher-vm1",
+		Containers: []*podresourcesapi.ContainerResources{{
+			Name: "compute",
+			Devices: []*podresourcesapi.ContainerDevices{
+				{ResourceName: "xdxct.com/1330", DeviceIds: []string{"8"}},
+				{ResourceName: "example.com/nic", DeviceIds: []string{"7"}},
+			},
+		}},
+	})
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	waitForReady(t, dp)
+	dp.reportHealth("7", pluginapi.Unhealthy, "test")
+	pciPluginsLock.Lock()
+	pciPlugins["1330"] = dp
+	pciPluginsLock.Unlock()
+	t.Cleanup(func() {
+		pciPluginsLock.Lock()
+		delete(pciPlugins, "1330")
+		pciPluginsLock.Unlock()
+	})
+
+	expected := `
+# HELP xdxct_device_plugin_allocated_devices Advertised devices assigned to a running container according to the kubelet pod resources API.
+# TYPE xdxct_device_plugin_allocated_devices gauge
+xdxct_device_plugin_allocated_devices{resource="1330"} 1
+# HELP xdxct_device_plugin_device_healthy 1 if the device is healthy, 0 otherwise. The device is an IOMMU group for passthrough GPUs and an mdev UUID for vGPUs.
+# TYPE xdxct_device_plugin_device_healthy gauge
+xdxct_device_plugin_device_healthy{device="7",parent_gpu="0000:3b:00.0",resource="1330"} 0
+xdxct_device_plugin_device_healthy{device="8",parent_gpu="0000:3c:00.0",resource="1330"} 1
+# HELP xdxct_device_plugin_devices Devices advertised to kubelet.
+# TYPE xdxct_device_plugin_devices gauge
+xdxct_device_plugin_devices{resource="1330"} 2
+# HELP xdxct_device_plugin_healthy_devices Advertised devices that are healthy.
+# TYPE xdxct_device_plugin_healthy_devices gauge
+xdxct_device_plugin_healthy_devices{resource="1330"} 1
+# HELP xdxct_device_plugin_registered 1 if the device plugin is registered with kubelet, 0 while registration is being retried.
+# TYPE xdxct_device_plugin_registered gauge
+xdxct_device_plugin_registered{resource="1330"} 1
+# HELP xdxct_device_plugin_unhealthy_devices Advertised devices that are unhealthy.
+# TYPE xdxct_device_plugin_unhealthy_devices gauge
+xdxct_device_plugin_unhealthy_devices{resource="1330"} 1
+`
+	collector := newDeviceCollector()
+	collector.allocations.refresh()
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeviceCollectorSlowKubelet(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	release := newSlowPodResources(t, &podresourcesapi.PodResources{
+		Name: "virt-launcher-vm1",
+		Containers: []*podresourcesapi.ContainerResources{{
+			Name:    "compute",
+			Devices: []*podresourcesapi.ContainerDevices{{ResourceName: "xdxct.com/1330", DeviceIds: []string{"8"}}},
+		}},
+	})
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	waitForReady(t, dp)
+	pciPluginsLock.Lock()
+	pciPlugins["1330"] = dp
+	pciPluginsLock.Unlock()
+	t.Cleanup(func() {
+		pciPluginsLock.Lock()
+		delete(pciPlugins, "1330")
+		pciPluginsLock.Unlock()
+	})
+
+	// scrapes do not wait for kubelet and leave out the allocations meanwhile
+	collector := newDeviceCollector()
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if n := testutil.CollectAndCount(collector, "xdxct_device_plugin_allocated_devices"); n != 0 {
+			t.Errorf("allocated_devices reported %d times before kubelet answered", n)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("scrape took %v", elapsed)
+		}
+	}
+
+	close(release)
+	deadline := time.Now().Add(testTimeout)
+	for testutil.CollectAndCount(collector, "xdxct_device_plugin_allocated_devices") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("allocations never read from kubelet")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expected := `
+# HELP xdxct_device_plugin_allocated_devices Advertised devices assigned to a running container according to the kubelet pod resources API.
+# TYPE xdxct_device_plugin_allocated_devices gauge
+xdxct_device_plugin_allocated_devices{resource="1330"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "xdxct_device_plugin_allocated_devices"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAllocateMetrics(t *testing.T) {
+	s := newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	client := dialDevicePlugin(t, dp)
+
+	requests := testutil.ToFloat64(allocateRequests.WithLabelValues("1330"))
+	failures := testutil.ToFloat64(allocateFailures.WithLabelValues("1330"))
+
+	client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"7"}}},
+	})
+	s.moveToIommuGroup("0000:3c:00.0", "9")
+	client.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"8"}}},
+	})
+
+	if got := testutil.ToFloat64(allocateRequests.WithLabelValues("1330")) - requests; got != 2 {
+		t.Errorf("allocate_requests_total increased by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(allocateFailures.WithLabelValues("1330")) - failures; got != 1 {
+		t.Errorf("allocate_failures_total increased by %v, want 1", got)
+	}
+}
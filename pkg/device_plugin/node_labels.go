@@ -0,0 +1,234 @@
+package device_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// a failed node update is retried after this long, or earlier if the
+// inventory changes again.
+var nodeLabelRetryInterval = 10 * time.Second
+
+// Node labels, below the resource namespace, e.g. xdxct.com/gpu.count.
+const (
+	labelGpuProduct = "gpu.product"
+	labelGpuCount   = "gpu.count"
+	labelGpuMode    = "gpu.mode"
+	labelVgpuTypes  = "vgpu.types"
+)
+
+// gpu.mode values
+const (
+	gpuModePassthrough = "passthrough"
+	gpuModeVgpu        = "vgpu"
+	gpuModeMixed       = "mixed"
+)
+
+// gpu.product of a node with GPUs of different products
+const gpuProductMixed = "mixed"
+
+// gpu.product only counts display controllers, not the audio or other
+// functions sharing an IOMMU group with a GPU.
+const displayClassPrefix = "03"
+
+// nodeLabelsChanged wakes the node labeler after a discovery, see updateNodeLabels.
+var nodeLabelsChanged = make(chan struct{}, 1)
+
+// updateNodeLabels makes the node labeler, if enabled, publish the current
+// inventory.
+func updateNodeLabels() {
+	notify(nodeLabelsChanged)
+}
+
+// nodeLabeler keeps the labels describing the GPU inventory on the node
+// object. It only ever touches the labels it manages.
+type nodeLabeler struct {
+	client   kubernetes.Interface
+	nodeName string
+	applied  map[string]string // what the node was last patched with, nil before the first patch
+}
+
+func newNodeLabeler(client kubernetes.Interface, nodeName string) *nodeLabeler {
+	return &nodeLabeler{client: client, nodeName: nodeName}
+}
+
+// run labels the node right away and again whenever changed fires, until ctx
+// is canceled.
+func (l *nodeLabeler) run(ctx context.Context, changed <-chan struct{}) {
+	log.Printf("Labeling node %s with the GPU inventory", l.nodeName)
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-retry.C:
+		}
+		if err := l.sync(ctx); err != nil {
+			log.Printf("Failed to label node %s, retrying in %s: %v", l.nodeName, nodeLabelRetryInterval, err)
+			retry.Reset(nodeLabelRetryInterval)
+		}
+	}
+}
+
+// sync patches the node if the inventory labels differ from the ones applied
+// last. Managed labels without a value are removed.
+func (l *nodeLabeler) sync(ctx context.Context) error {
+	labels := nodeLabels()
+	if l.applied != nil && reflect.DeepEqual(labels, l.applied) {
+		return nil
+	}
+
+	patchLabels := make(map[string]interface{})
+	for _, key := range nodeLabelKeys() {
+		if value, ok := labels[key]; ok {
+			patchLabels[key] = value
+		} else {
+			patchLabels[key] = nil
+		}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": patchLabels},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := l.client.CoreV1().Nodes().Patch(ctx, l.nodeName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	log.Printf("Labeled node %s: %v", l.nodeName, labels)
+	l.applied = labels
+	return nil
+}
+
+// nodeLabelKeys returns every label the labeler manages.
+func nodeLabelKeys() []string {
+	var keys []string
+	for _, name := range []string{labelGpuProduct, labelGpuCount, labelGpuMode, labelVgpuTypes} {
+		keys = append(keys, nodeLabelKey(name))
+	}
+	return keys
+}
+
+// displayProduct returns the resource name the function at addr is
+// advertised under, if it is a selected display controller.
+func displayProduct(addr string) (string, bool) {
+	class, err := readIDFromFile(basePciPath, addr, "class")
+	if err != nil || !strings.HasPrefix(class, displayClassPrefix) {
+		return "", false
+	}
+	match, ok := selectPciDevice(addr)
+	if !ok {
+		return "", false
+	}
+	deviceID, err := readIDFromFile(basePciPath, addr, "device")
+	if err != nil {
+		return "", false
+	}
+	return match.resourceName(deviceID), true
+}
+
+func nodeLabelKey(name string) string {
+	return fmt.Sprintf("%s/%s", DeviceNamespace, name)
+}
+
+// nodeLabels describes the GPUs in the device maps: passthrough GPUs advertised
+// under the resource namespace and GPUs carrying vGPUs. Devices of other
+// device sets are not labeled. Labels that do not apply, or whose value is not
+// a valid label value, are left out.
+func nodeLabels() map[string]string {
+	deviceMapLock.RLock()
+	devices := pciResources(deviceMap)
+	iommus := make(map[string][]XdxctGpuDevice, len(iommuMap))
+	for group, devs := range iommuMap {
+		iommus[group] = devs
+	}
+	namespaces := make(map[string]string, len(pciNamespaceMap))
+	for name, namespace := range pciNamespaceMap {
+		namespaces[name] = namespace
+	}
+	vgpus := vgpuResources(vGpuMap)
+	var parents []string
+	for addr := range gpuVgpuMap {
+		if addr != "" {
+			parents = append(parents, addr)
+		}
+	}
+	deviceMapLock.RUnlock()
+
+	products := make(map[string]bool)
+	passthrough := 0
+	for name, groups := range devices {
+		if namespace, ok := namespaces[name]; ok && namespace != DeviceNamespace {
+			continue
+		}
+		for _, group := range groups {
+			for _, dev := range iommus[group] {
+				if product, ok := displayProduct(dev.addr); ok {
+					products[product] = true
+				}
+			}
+		}
+		passthrough += len(groups)
+	}
+	for _, addr := range parents {
+		deviceID, err := readIDFromFile(basePciPath, addr, "device")
+		if err != nil {
+			continue
+		}
+		products[getConfig().pciResourceName(deviceID)] = true
+	}
+
+	labels := make(map[string]string)
+	set := func(name string, value string) {
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			log.Printf("Not labeling node with %s=%s: %s", nodeLabelKey(name), value, strings.Join(errs, "; "))
+			return
+		}
+		labels[nodeLabelKey(name)] = value
+	}
+
+	if count := passthrough + len(parents); count > 0 {
+		set(labelGpuCount, strconv.Itoa(count))
+	}
+	switch {
+	case passthrough > 0 && len(parents) > 0:
+		set(labelGpuMode, gpuModeMixed)
+	case passthrough > 0:
+		set(labelGpuMode, gpuModePassthrough)
+	case len(parents) > 0:
+		set(labelGpuMode, gpuModeVgpu)
+	}
+	switch len(products) {
+	case 0:
+	case 1:
+		for product := range products {
+			set(labelGpuProduct, product)
+		}
+	default:
+		set(labelGpuProduct, gpuProductMixed)
+	}
+	if len(vgpus) > 0 {
+		var names []string
+		for name := range vgpus {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		set(labelVgpuTypes, strings.Join(names, "."))
+	}
+	return labels
+}
@@ -0,0 +1,127 @@
+package device_plugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func getNodeLabels(t *testing.T, client *fake.Clientset) map[string]string {
+	t.Helper()
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node.Labels
+}
+
+func TestNodeLabels(t *testing.T) {
+	s := newTestHost(t)
+	createIommuDeviceMap()
+	createVgpuMap()
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node1",
+		Labels: map[string]string{"kubernetes.io/os": "linux", "xdxct.com/vgpu.types": "stale"},
+	}})
+	labeler := newNodeLabeler(client, "node1")
+
+	if err := labeler.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"kubernetes.io/os":      "linux",
+		"xdxct.com/gpu.product": "1330",
+		"xdxct.com/gpu.count":   "3",
+		"xdxct.com/gpu.mode":    "mixed",
+		"xdxct.com/vgpu.types":  "XGV_V0_1G_1_CORE",
+	}
+	if got := getNodeLabels(t, client); !reflect.DeepEqual(got, want) {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+
+	// unchanged inventory, no further update
+	client.ClearActions()
+	if err := labeler.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("unchanged inventory patched the node: %v", actions)
+	}
+
+	s.removeMdev("0000:5e:00.0", "9d5c5a1e-1b4a-4e0a-8a3e-000000000001")
+	s.removeMdev("0000:5e:00.0", "9d5c5a1e-1b4a-4e0a-8a3e-000000000002")
+	createVgpuMap()
+	if err := labeler.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{
+		"kubernetes.io/os":      "linux",
+		"xdxct.com/gpu.product": "1330",
+		"xdxct.com/gpu.count":   "2",
+		"xdxct.com/gpu.mode":    "passthrough",
+	}
+	if got := getNodeLabels(t, client); !reflect.DeepEqual(got, want) {
+		t.Errorf("labels after removing the vGPUs = %v, want %v", got, want)
+	}
+}
+
+func TestNodeLabelerRetries(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+	createVgpuMap()
+	defer func(interval time.Duration) { nodeLabelRetryInterval = interval }(nodeLabelRetryInterval)
+	nodeLabelRetryInterval = 10 * time.Millisecond
+
+	// the node is created after the first attempt failed
+	client := fake.NewSimpleClientset()
+	labeler := newNodeLabeler(client, "node1")
+	if err := labeler.sync(context.Background()); err == nil {
+		t.Fatal("labeling a missing node succeeded")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		labeler.run(ctx, make(chan struct{}))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	if _, err := client.CoreV1().Nodes().Create(context.Background(), &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for getNodeLabels(t, client)["xdxct.com/gpu.count"] != "3" {
+		if time.Now().After(deadline) {
+			t.Fatalf("node not labeled after retrying: %v", getNodeLabels(t, client))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodeLabelsGpuProduct(t *testing.T) {
+	s := newTestHost(t)
+	// the audio function of a GPU in an IOMMU group of its own
+	s.addPciDevice(pciDevice{addr: "0000:3d:00.0", vendor: "1eed", device: "1330", class: "030000", driver: "vfio-pci", group: "9", numa: 1})
+	s.addPciDevice(pciDevice{addr: "0000:3d:00.1", vendor: "1eed", device: "1331", class: "040300", driver: "vfio-pci", group: "10", numa: 1})
+	createIommuDeviceMap()
+	createVgpuMap()
+
+	if got := nodeLabels()["xdxct.com/gpu.product"]; got != "1330" {
+		t.Errorf("gpu.product = %q, want 1330", got)
+	}
+
+	// a GPU of another product
+	s.addPciDevice(pciDevice{addr: "0000:af:00.0", vendor: "1eed", device: "1340", class: "030000", driver: "vfio-pci", group: "11", numa: 1})
+	createIommuDeviceMap()
+	if got := nodeLabels()["xdxct.com/gpu.product"]; got != gpuProductMixed {
+		t.Errorf("gpu.product = %q, want %s", got, gpuProductMixed)
+	}
+}
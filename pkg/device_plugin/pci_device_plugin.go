@@ -0,0 +1,170 @@
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+var returnIommuMap = getIommuMap
+
+// pciBackend advertises whole IOMMU groups bound to their passthrough driver.
+type pciBackend struct {
+	devicePath string // the IOMMU groups directory watched for health
+}
+
+func NewGenericaDevicePlugin(deviceName string, devicePath string) *GenericDevicePlugin {
+	return newGenericDevicePlugin(deviceName, pciNamespace(deviceName), &pciBackend{devicePath: devicePath})
+}
+
+func (b *pciBackend) enumerate(deviceName string) []*pluginapi.Device {
+	deviceMapLock.RLock()
+	defer deviceMapLock.RUnlock()
+	return buildPciDevices(pciResources(deviceMap)[deviceName], iommuMap)
+}
+
+func (b *pciBackend) preferredAllocation(in *pluginapi.PreferredAllocationRequest) *pluginapi.PreferredAllocationResponse {
+	iommus := returnIommuMap()
+	topologyOf := func(iommuGroup string) deviceTopology {
+		devs := iommus[iommuGroup]
+		if len(devs) == 0 {
+			return deviceTopology{numaNode: -1}
+		}
+		return readPciTopology(devs[0].addr)
+	}
+	return preferredAllocation(in, topologyOf, allocationPolicyPack)
+}
+
+func (b *pciBackend) allocate(dp *GenericDevicePlugin, ids []string) (*pluginapi.ContainerAllocateResponse, error) {
+	deviceSpecs := make([]*pluginapi.DeviceSpec, 0)
+	envList := map[string][]string{}
+
+	for _, iommuId := range ids {
+		devAddrs := []string{}
+
+		returnedMap := returnIommuMap()
+		//Retrieve the devices associated with a Iommu group
+		xdxDev := returnedMap[iommuId]
+		if len(xdxDev) == 0 {
+			// rediscovery removed the group since kubelet last listed it
+			log.Println("IommuGroup is no longer advertised ", iommuId)
+			return nil, status.Errorf(codes.FailedPrecondition, "invalid allocation request: IOMMU group %s is no longer available", iommuId)
+		}
+		for _, dev := range xdxDev {
+			iommuGroup, err := readLink(basePciPath, dev.addr, "iommu_group")
+			if err != nil || iommuGroup != iommuId {
+				log.Println("IommuGroup has changed on the system ", dev.addr)
+				return nil, status.Errorf(codes.FailedPrecondition, "invalid allocation request: unknown device: %s", dev.addr)
+			}
+			if !isSelectedPciDevice(dev.addr) {
+				log.Println("Device no longer matches any selector ", dev.addr)
+				return nil, status.Errorf(codes.FailedPrecondition, "invalid allocation request: unknown device: %s", dev.addr)
+			}
+
+			devAddrs = append(devAddrs, dev.addr)
+
+		}
+		deviceSpecs = append(deviceSpecs, &pluginapi.DeviceSpec{
+			HostPath:      filepath.Join(vfioDevicePath, "vfio"),
+			ContainerPath: filepath.Join(vfioDevicePath, "vfio"),
+			Permissions:   "mrw",
+		})
+		deviceSpecs = append(deviceSpecs, &pluginapi.DeviceSpec{
+			HostPath:      filepath.Join(vfioDevicePath, iommuId),
+			ContainerPath: filepath.Join(vfioDevicePath, iommuId),
+			Permissions:   "mrw",
+		})
+
+		key := resourceEnvName(gpuPrefix, dp.resourceName())
+		if _, exists := envList[key]; !exists {
+			envList[key] = []string{}
+		}
+		envList[key] = append(envList[key], devAddrs...)
+	}
+	return &pluginapi.ContainerAllocateResponse{
+		Envs:       buildEnv(envList),
+		Devices:    deviceSpecs,
+		CDIDevices: cdiDevices(cdiKind(dp.namespace, cdiClassGpu), ids),
+	}, nil
+}
+
+// healthCheck watches the IOMMU group directory of every advertised device and
+// marks the device unhealthy when its directory is removed. Unbinding the
+// devices from vfio-pci does not remove it; the rediscovery handles that.
+func (b *pciBackend) healthCheck(ctx context.Context, dp *GenericDevicePlugin) error {
+	method := fmt.Sprintf("healthCheck(%s)", dp.deviceName)
+	log.Printf("%s: invoked", method)
+	var pathDeviceMap = make(map[string]string)
+	var path = b.devicePath
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("%s: unable to create fsnotify watcher: %v", method, err)
+		return err
+	}
+	defer watcher.Close()
+
+	_, err = os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("%s: Unable to stat device: %v", method, err)
+			return err
+		}
+	}
+
+	for _, id := range dp.deviceIDs() {
+		devicePath := filepath.Join(path, id)
+		err = watcher.Add(devicePath)
+		pathDeviceMap[devicePath] = id
+		if err != nil {
+			log.Printf("%s: Unable to add device path to fsnotify watcher: %v", method, err)
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-dp.rewatch:
+			current := make(map[string]string)
+			for _, id := range dp.deviceIDs() {
+				current[filepath.Join(path, id)] = id
+			}
+			for devicePath := range pathDeviceMap {
+				if _, ok := current[devicePath]; !ok {
+					watcher.Remove(devicePath)
+					delete(pathDeviceMap, devicePath)
+				}
+			}
+			for devicePath, id := range current {
+				if _, ok := pathDeviceMap[devicePath]; ok {
+					continue
+				}
+				if err := watcher.Add(devicePath); err != nil {
+					log.Printf("%s: Unable to add device path to fsnotify watcher: %v", method, err)
+					continue
+				}
+				pathDeviceMap[devicePath] = id
+			}
+		case event := <-watcher.Events:
+			v, ok := pathDeviceMap[event.Name]
+			if !ok {
+				continue
+			}
+			if event.Op == fsnotify.Create {
+				dp.reportHealth(v, pluginapi.Healthy, "")
+			} else if (event.Op == fsnotify.Remove) || (event.Op == fsnotify.Rename) {
+				log.Printf("%s: Marking device unhealthy: %s", method, event.Name)
+				dp.reportHealth(v, pluginapi.Unhealthy, fmt.Sprintf("IOMMU group %s was removed", v))
+			}
+		}
+	}
+}
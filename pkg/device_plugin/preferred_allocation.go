@@ -0,0 +1,123 @@
+package device_plugin
+
+import (
+	"log"
+	"sort"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// vgpuAllocationPolicyEnv selects, when the configuration file does not, how
+// multi-vGPU requests are laid out over the parent GPUs: "pack" (default)
+// keeps them on as few GPUs as possible, "spread" puts each of them on a
+// different GPU where possible.
+const vgpuAllocationPolicyEnv = "XDXCT_VGPU_ALLOCATION_POLICY"
+
+const (
+	allocationPolicyPack   = "pack"
+	allocationPolicySpread = "spread"
+)
+
+// Weights of the preferred allocation score. Sharing a NUMA node matters most,
+// then every shared level of PCIe hierarchy (root bus, switch ports). The
+// policy only decides between vGPUs that are equally close otherwise.
+const (
+	sameNumaScore       = 100
+	sharedAncestryScore = 10
+	packSameParentScore = 50
+)
+
+// preferredAllocation builds the preferred allocation response for every
+// container request, describing each available device with topologyOf.
+func preferredAllocation(in *pluginapi.PreferredAllocationRequest, topologyOf func(id string) deviceTopology, policy string) *pluginapi.PreferredAllocationResponse {
+	response := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range in.ContainerRequests {
+		topology := make(map[string]deviceTopology, len(req.AvailableDeviceIDs))
+		for _, id := range req.AvailableDeviceIDs {
+			topology[id] = topologyOf(id)
+		}
+		ids := selectPreferredDevices(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize), topology, policy)
+		log.Printf("Preferred allocation of %d out of %v: %v", req.AllocationSize, req.AvailableDeviceIDs, ids)
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: ids,
+		})
+	}
+	return response
+}
+
+// selectPreferredDevices starts from mustInclude and greedily adds the
+// available device closest to the devices chosen so far. The first device,
+// when nothing is mandated, is taken from the smallest NUMA node that can
+// still hold the whole request, leaving larger nodes for larger requests.
+func selectPreferredDevices(available, mustInclude []string, size int, topology map[string]deviceTopology, policy string) []string {
+	selected := append([]string{}, mustInclude...)
+	chosen := make(map[string]bool, len(mustInclude))
+	for _, id := range mustInclude {
+		chosen[id] = true
+	}
+
+	var candidates []string
+	for _, id := range available {
+		if !chosen[id] {
+			candidates = append(candidates, id)
+		}
+	}
+	sort.Strings(candidates)
+
+	for len(selected) < size && len(candidates) > 0 {
+		best, bestScore := 0, 0
+		for i, id := range candidates {
+			var score int
+			if len(selected) == 0 {
+				score = seedScore(id, candidates, size, topology)
+			} else {
+				score = placementScore(id, selected, topology, policy)
+			}
+			if i == 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		selected = append(selected, candidates[best])
+		candidates = append(candidates[:best], candidates[best+1:]...)
+	}
+	return selected
+}
+
+// seedScore rates a device as the first pick of a request by how well its
+// NUMA node fits the request size.
+func seedScore(id string, candidates []string, size int, topology map[string]deviceTopology) int {
+	peers := 0
+	for _, other := range candidates {
+		if topology[other].numaNode == topology[id].numaNode {
+			peers++
+		}
+	}
+	if peers >= size {
+		// best fit: the fewer devices left over on the node, the better
+		return len(candidates) - peers + len(candidates)
+	}
+	return peers
+}
+
+// placementScore rates how close a device is to the devices already selected.
+func placementScore(id string, selected []string, topology map[string]deviceTopology, policy string) int {
+	score := 0
+	dev := topology[id]
+	for _, other := range selected {
+		peer := topology[other]
+		if dev.numaNode == peer.numaNode {
+			score += sameNumaScore
+		}
+		if dev.parent != "" && dev.parent == peer.parent {
+			if policy == allocationPolicySpread {
+				// no credit for the shared PCIe path, so a different GPU
+				// on the same NUMA node always wins over the same GPU
+				score--
+				continue
+			}
+			score += packSameParentScore
+		}
+		score += sharedAncestryScore * commonAncestry(dev, peer)
+	}
+	return score
+}
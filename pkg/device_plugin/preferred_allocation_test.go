@@ -0,0 +1,213 @@
+package device_plugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestSelectPreferredDevices(t *testing.T) {
+	switchA := []string{"pci0000:00", "0000:00:01.0"}
+	switchB := []string{"pci0000:00", "0000:00:02.0"}
+	vgpu := func(numa int, parent string) deviceTopology {
+		return deviceTopology{numaNode: numa, parent: parent, ancestry: []string{"pci0000:00", parent}}
+	}
+	// a and b on NUMA node 0, c, d and e on node 1
+	nodes := map[string]deviceTopology{
+		"a": {numaNode: 0}, "b": {numaNode: 0},
+		"c": {numaNode: 1}, "d": {numaNode: 1}, "e": {numaNode: 1},
+	}
+	// two vGPUs on each of two GPUs of the same NUMA node
+	vgpus := map[string]deviceTopology{
+		"g1-1": vgpu(0, "0000:3b:00.0"), "g1-2": vgpu(0, "0000:3b:00.0"),
+		"g2-1": vgpu(0, "0000:3c:00.0"), "g2-2": vgpu(0, "0000:3c:00.0"),
+	}
+
+	tests := []struct {
+		name        string
+		available   []string
+		mustInclude []string
+		size        int
+		topology    map[string]deviceTopology
+		policy      string
+		want        []string
+	}{{
+		name:      "best fit NUMA node",
+		available: []string{"a", "b", "c", "d", "e"},
+		size:      2,
+		topology:  nodes,
+		want:      []string{"a", "b"},
+	}, {
+		name:      "only node large enough",
+		available: []string{"a", "b", "c", "d", "e"},
+		size:      3,
+		topology:  nodes,
+		want:      []string{"c", "d", "e"},
+	}, {
+		name:      "request larger than any node",
+		available: []string{"a", "b", "c", "d", "e"},
+		size:      4,
+		topology:  nodes,
+		want:      []string{"c", "d", "e", "a"},
+	}, {
+		name:        "must include comes first",
+		available:   []string{"a", "b", "c", "d", "e"},
+		mustInclude: []string{"e"},
+		size:        2,
+		topology:    nodes,
+		want:        []string{"e", "c"},
+	}, {
+		name:        "must include exceeding the size",
+		available:   []string{"a", "b", "c"},
+		mustInclude: []string{"a", "c"},
+		size:        1,
+		topology:    nodes,
+		want:        []string{"a", "c"},
+	}, {
+		name:      "same PCIe switch",
+		available: []string{"a", "b", "c"},
+		size:      2,
+		topology: map[string]deviceTopology{
+			"a": {numaNode: 0, ancestry: switchA},
+			"b": {numaNode: 0, ancestry: switchB},
+			"c": {numaNode: 0, ancestry: switchA},
+		},
+		want: []string{"a", "c"},
+	}, {
+		name:      "unknown NUMA nodes fall back to the PCIe hierarchy",
+		available: []string{"a", "b", "c"},
+		size:      2,
+		topology: map[string]deviceTopology{
+			"a": {numaNode: -1, ancestry: switchB},
+			"b": {numaNode: -1, ancestry: switchA},
+			"c": {numaNode: -1, ancestry: switchB},
+		},
+		want: []string{"a", "c"},
+	}, {
+		name:      "unknown NUMA node is not local to a known one",
+		available: []string{"a", "b", "x"},
+		size:      2,
+		topology: map[string]deviceTopology{
+			"a": {numaNode: 0},
+			"b": {numaNode: 0},
+			"x": {numaNode: -1},
+		},
+		want: []string{"a", "b"},
+	}, {
+		name:      "pack vGPUs on one GPU",
+		available: []string{"g1-1", "g1-2", "g2-1", "g2-2"},
+		size:      2,
+		topology:  vgpus,
+		policy:    allocationPolicyPack,
+		want:      []string{"g1-1", "g1-2"},
+	}, {
+		name:      "spread vGPUs over GPUs",
+		available: []string{"g1-1", "g1-2", "g2-1", "g2-2"},
+		size:      2,
+		topology:  vgpus,
+		policy:    allocationPolicySpread,
+		want:      []string{"g1-1", "g2-1"},
+	}, {
+		name:      "spread falls back to the same GPU",
+		available: []string{"g1-1", "g1-2", "g2-1"},
+		size:      3,
+		topology:  vgpus,
+		policy:    allocationPolicySpread,
+		want:      []string{"g1-1", "g2-1", "g1-2"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectPreferredDevices(tt.available, tt.mustInclude, tt.size, tt.topology, tt.policy)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectPreferredDevices = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTopologyHost adds to newTestHost two GPUs behind a PCIe switch on NUMA
+// node 0, IOMMU groups 9 and 10, and a second vGPU parent on node 1.
+func newTopologyHost(t *testing.T) *fakeSysfs {
+	s := newTestHost(t)
+	s.addPciDevice(pciDevice{addr: "0000:3d:00.0", vendor: "1eed", device: "1330", class: "030000", driver: "vfio-pci", group: "9", numa: 0, upstream: "pci0000:00/0000:00:01.0"})
+	s.addPciDevice(pciDevice{addr: "0000:3e:00.0", vendor: "1eed", device: "1330", class: "030000", driver: "vfio-pci", group: "10", numa: 0, upstream: "pci0000:00/0000:00:01.0"})
+	s.addPciDevice(pciDevice{addr: "0000:5f:00.0", vendor: "1eed", device: "1330", class: "030000", driver: "xdxgpu", group: "25", numa: 1})
+	s.addMdevType("0000:5f:00.0", "xgv-XGV_V0_1G_1_CORE", "XGV_V0_1G_1_CORE", 2)
+	s.addMdev("0000:5f:00.0", "xgv-XGV_V0_1G_1_CORE", "9d5c5a1e-1b4a-4e0a-8a3e-000000000003", "23")
+	s.addMdev("0000:5f:00.0", "xgv-XGV_V0_1G_1_CORE", "9d5c5a1e-1b4a-4e0a-8a3e-000000000004", "24")
+	return s
+}
+
+func TestReadPciAncestry(t *testing.T) {
+	newTopologyHost(t)
+
+	behindSwitch := readPciTopology("0000:3d:00.0")
+	if want := []string{"pci0000:00", "0000:00:01.0"}; !reflect.DeepEqual(behindSwitch.ancestry, want) {
+		t.Errorf("ancestry of 0000:3d:00.0 = %v, want %v", behindSwitch.ancestry, want)
+	}
+	for _, tt := range []struct {
+		addr string
+		want int
+	}{
+		{"0000:3e:00.0", 2}, // same switch
+		{"0000:3b:00.0", 1}, // same root bus
+	} {
+		if got := commonAncestry(behindSwitch, readPciTopology(tt.addr)); got != tt.want {
+			t.Errorf("commonAncestry(0000:3d:00.0, %s) = %d, want %d", tt.addr, got, tt.want)
+		}
+	}
+	if got := readPciAncestry("0000:ff:00.0"); got != nil {
+		t.Errorf("ancestry of a missing device = %v", got)
+	}
+
+	vgpu := readVgpuTopology("0000:5e:00.0")
+	if want := []string{"pci0000:00", "0000:5e:00.0"}; vgpu.parent != "0000:5e:00.0" || !reflect.DeepEqual(vgpu.ancestry, want) {
+		t.Errorf("vGPU topology = %+v", vgpu)
+	}
+}
+
+func preferredDevices(t *testing.T, dp *GenericDevicePlugin, available []string, size int32) []string {
+	t.Helper()
+	resp, err := dialDevicePlugin(t, dp).GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs: available,
+			AllocationSize:     size,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.ContainerResponses[0].DeviceIDs
+}
+
+func TestGetPreferredAllocation(t *testing.T) {
+	s := newTopologyHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+	createVgpuMap()
+
+	pci := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, pci)
+	// node 0 fits the request, on it the GPUs behind the switch are closest
+	if got, want := preferredDevices(t, pci, []string{"7", "8", "9", "10"}, 2), []string{"10", "9"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("passthrough = %v, want %v", got, want)
+	}
+
+	available := []string{
+		"9d5c5a1e-1b4a-4e0a-8a3e-000000000001", "9d5c5a1e-1b4a-4e0a-8a3e-000000000002",
+		"9d5c5a1e-1b4a-4e0a-8a3e-000000000003", "9d5c5a1e-1b4a-4e0a-8a3e-000000000004",
+	}
+	vgpu := NewGenericaVgpuDevicePlugin("XGV_V0_1G_1_CORE", vGpuBasePath)
+	startTestPlugin(t, vgpu)
+	if got, want := preferredDevices(t, vgpu, available, 2), available[:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("pack = %v, want %v", got, want)
+	}
+	cfg := *s.cfg
+	cfg.VgpuAllocationPolicy = allocationPolicySpread
+	swapConfig(&cfg)
+	if got, want := preferredDevices(t, vgpu, available, 2), []string{available[0], available[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("spread = %v, want %v", got, want)
+	}
+}
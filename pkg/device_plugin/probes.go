@@ -0,0 +1,181 @@
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listAndWatchGrace is how long a registered plugin may go without a
+// ListAndWatch stream from kubelet before it is considered wedged. Kubelet
+// opens the stream right after registration and keeps it open.
+var listAndWatchGrace = time.Minute
+
+// pluginStatus is what the probes know about the current server of a plugin.
+type pluginStatus struct {
+	serving    bool
+	registered bool
+	regErr     string    // why the last registration attempt failed
+	streams    int       // open ListAndWatch streams
+	idleSince  time.Time // registration or end of the last stream
+	failure    string    // why a goroutine of the plugin died, if one did
+}
+
+func (dp *GenericDevicePlugin) setServing(serving bool) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	dp.status.serving = serving
+	if !serving {
+		dp.status.registered = false
+	}
+}
+
+func (dp *GenericDevicePlugin) setRegistered() {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	dp.status.registered = true
+	dp.status.regErr = ""
+	dp.status.idleSince = time.Now()
+}
+
+func (dp *GenericDevicePlugin) setRegistrationFailed(err error) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	dp.status.registered = false
+	dp.status.regErr = err.Error()
+}
+
+func (dp *GenericDevicePlugin) isRegistered() bool {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	return dp.status.registered
+}
+
+func (dp *GenericDevicePlugin) streamStarted() {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	dp.status.streams++
+}
+
+func (dp *GenericDevicePlugin) streamEnded() {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	dp.status.streams--
+	dp.status.idleSince = time.Now()
+}
+
+// exited records a goroutine of the plugin returning an error while the
+// plugin is still supposed to be running.
+func (dp *GenericDevicePlugin) exited(ctx context.Context, name string, err error) {
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	log.Printf("%s: %s exited: %v", dp.deviceName, name, err)
+	dp.setFailure(fmt.Sprintf("%s exited: %v", name, err))
+}
+
+// setFailure makes live fail until the next server of the plugin starts.
+func (dp *GenericDevicePlugin) setFailure(failure string) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	dp.status.failure = failure
+}
+
+// ready reports why the plugin cannot be used by kubelet yet, or nil.
+func (dp *GenericDevicePlugin) ready() error {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	if !dp.status.serving {
+		return fmt.Errorf("gRPC server is not serving")
+	}
+	if !dp.status.registered {
+		if dp.status.regErr != "" {
+			return fmt.Errorf("not registered with kubelet: %s", dp.status.regErr)
+		}
+		return fmt.Errorf("not registered with kubelet")
+	}
+	return nil
+}
+
+// live reports why the plugin is wedged and needs a restart, or nil.
+func (dp *GenericDevicePlugin) live() error {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+	if dp.status.failure != "" {
+		return fmt.Errorf("%s", dp.status.failure)
+	}
+	if dp.status.registered && dp.status.streams == 0 && time.Since(dp.status.idleSince) > listAndWatchGrace {
+		return fmt.Errorf("no ListAndWatch stream from kubelet for %s", time.Since(dp.status.idleSince).Round(time.Second))
+	}
+	return nil
+}
+
+// checkReady requires a serving, registered plugin for every discovered resource.
+func checkReady() error {
+	deviceMapLock.RLock()
+	pciExpected := pciResources(deviceMap)
+	vgpuExpected := vgpuResources(vGpuMap)
+	deviceMapLock.RUnlock()
+
+	var errs []string
+	check := func(lock sync.Locker, plugins map[string]*GenericDevicePlugin, deviceName string) {
+		lock.Lock()
+		dp, ok := plugins[deviceName]
+		lock.Unlock()
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: device plugin is not running", deviceName))
+			return
+		}
+		if err := dp.ready(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", deviceName, err))
+		}
+	}
+	for deviceName := range pciExpected {
+		check(&pciPluginsLock, pciPlugins, deviceName)
+	}
+	for deviceName := range vgpuExpected {
+		check(&vgpuPluginsLock, vgpuPlugins, deviceName)
+	}
+	return joinProbeErrors(errs)
+}
+
+// checkLive fails if any running plugin is wedged.
+func checkLive() error {
+	var errs []string
+	check := func(lock sync.Locker, plugins map[string]*GenericDevicePlugin) {
+		lock.Lock()
+		defer lock.Unlock()
+		for deviceName, dp := range plugins {
+			if err := dp.live(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", deviceName, err))
+			}
+		}
+	}
+	check(&pciPluginsLock, pciPlugins)
+	check(&vgpuPluginsLock, vgpuPlugins)
+	return joinProbeErrors(errs)
+}
+
+func joinProbeErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return fmt.Errorf("%s", strings.Join(errs, "\n"))
+}
+
+// probeHandler answers 200 ok, or 503 with the reasons the check failed.
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,92 @@
+package device_plugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerTestPlugin records dp in pciPlugins for the duration of the test.
+func registerTestPlugin(t *testing.T, dp *GenericDevicePlugin) {
+	pciPluginsLock.Lock()
+	pciPlugins[dp.deviceName] = dp
+	pciPluginsLock.Unlock()
+	t.Cleanup(func() {
+		pciPluginsLock.Lock()
+		delete(pciPlugins, dp.deviceName)
+		pciPluginsLock.Unlock()
+	})
+}
+
+func TestReadiness(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+
+	if err := checkReady(); err == nil || !strings.Contains(err.Error(), "1330: device plugin is not running") {
+		t.Errorf("checkReady() = %v, want the missing 1330 plugin reported", err)
+	}
+
+	// kubelet is not listening, so registration fails
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	registerTestPlugin(t, dp)
+	if err := checkReady(); err == nil || !strings.Contains(err.Error(), "1330: not registered with kubelet") {
+		t.Errorf("checkReady() = %v, want 1330 reported as not registered", err)
+	}
+
+	newFakeKubelet(t)
+	waitForReady(t, dp)
+	if err := checkReady(); err != nil {
+		t.Errorf("checkReady() = %v, want ready", err)
+	}
+
+	dp.Stop()
+	if err := checkReady(); err == nil || !strings.Contains(err.Error(), "1330: gRPC server is not serving") {
+		t.Errorf("checkReady() = %v, want 1330 reported as not serving", err)
+	}
+}
+
+func TestLivenessWithoutListAndWatch(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+	setDuration(t, &listAndWatchGrace, 100*time.Millisecond)
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	registerTestPlugin(t, dp)
+	waitForReady(t, dp)
+	if err := checkLive(); err != nil {
+		t.Errorf("checkLive() = %v right after registration, want live", err)
+	}
+
+	time.Sleep(2 * listAndWatchGrace)
+	if err := checkLive(); err == nil || !strings.Contains(err.Error(), "no ListAndWatch stream") {
+		t.Errorf("checkLive() = %v, want the missing ListAndWatch stream reported", err)
+	}
+
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	recvDevices(t, stream)
+	if err := checkLive(); err != nil {
+		t.Errorf("checkLive() = %v with an open ListAndWatch stream, want live", err)
+	}
+}
+
+func TestLivenessHealthCheckDied(t *testing.T) {
+	newTestHost(t)
+	newFakeKubelet(t)
+	createIommuDeviceMap()
+
+	// a device path that cannot be watched makes the health check give up
+	dp := newGenericDevicePlugin("1330", DeviceNamespace, &pciBackend{devicePath: "/nonexistent"})
+	startTestPlugin(t, dp)
+	registerTestPlugin(t, dp)
+
+	deadline := time.Now().Add(testTimeout)
+	for checkLive() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := checkLive(); err == nil || !strings.Contains(err.Error(), "health check exited") {
+		t.Errorf("checkLive() = %v, want the dead health check reported", err)
+	}
+}
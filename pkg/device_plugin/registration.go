@@ -0,0 +1,137 @@
+package device_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Backoff between registration attempts while kubelet is not accepting them.
+var (
+	registrationBackoffInitial = time.Second
+	registrationBackoffMax     = time.Minute
+)
+
+// superviseRegistration registers the plugin with kubelet, retrying with
+// exponential backoff until it succeeds, and registers it again whenever
+// kubelet.sock is recreated. It also restarts the plugin when its own socket is
+// removed, which is what kubelet does to every plugin socket when it restarts.
+func (dp *GenericDevicePlugin) superviseRegistration(ctx context.Context) error {
+	method := fmt.Sprintf("registration(%s)", dp.deviceName)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("%s: unable to create fsnotify watcher: %v", method, err)
+		return err
+	}
+	defer watcher.Close()
+
+	for _, dir := range uniqueDirs(dp.sockPath, kubeletSocket) {
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("%s: Unable to add %s to fsnotify watcher: %v", method, dir, err)
+			return err
+		}
+	}
+
+	backoff := registrationBackoffInitial
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-retry.C:
+			if err := dp.Register(); err != nil {
+				dp.setRegistrationFailed(err)
+				log.Printf("%s: Unable to register with kubelet, retrying in %s: %v", method, backoff, err)
+				retry.Reset(backoff)
+				backoff *= 2
+				if backoff > registrationBackoffMax {
+					backoff = registrationBackoffMax
+				}
+				continue
+			}
+			log.Printf("%s: Registered %s with kubelet", method, dp.resourceName())
+			dp.setRegistered()
+			backoff = registrationBackoffInitial
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("fsnotify watcher closed")
+			}
+			log.Printf("%s: fsnotify watcher error: %v", method, err)
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("fsnotify watcher closed")
+			}
+			switch {
+			case event.Name == kubeletSocket && event.Op&fsnotify.Create != 0:
+				log.Printf("%s: kubelet socket was recreated, registering again", method)
+				if dp.isRegistered() {
+					reregistrations.WithLabelValues(dp.deviceName).Inc()
+				}
+				backoff = registrationBackoffInitial
+				resetTimer(retry, 0)
+			case event.Name == dp.sockPath && event.Op&fsnotify.Remove != 0:
+				log.Printf("%s: Socket path for GPU device was removed, kubelet likely restarted", method)
+				reregistrations.WithLabelValues(dp.deviceName).Inc()
+				// Stop waits for this goroutine, so restart from another one
+				go dp.restartUntilServing(method)
+				return nil
+			}
+		}
+	}
+}
+
+// restartUntilServing restarts the server of the plugin, retrying with the
+// registration backoff until it succeeds or the plugin is stopped. Every
+// failure is recorded, so /healthz fails while the plugin has no server.
+func (dp *GenericDevicePlugin) restartUntilServing(method string) {
+	done := dp.done()
+	backoff := registrationBackoffInitial
+	for {
+		err := dp.restart()
+		if err == nil {
+			log.Printf("%s: Successfully restarted %s device plugin server", method, dp.deviceName)
+			return
+		}
+		dp.setFailure(fmt.Sprintf("restart failed: %v", err))
+		log.Printf("%s: Unable to restart server, retrying in %s: %v", method, backoff, err)
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > registrationBackoffMax {
+			backoff = registrationBackoffMax
+		}
+	}
+}
+
+// resetTimer makes t fire after d, whether or not it has fired already.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+func uniqueDirs(paths ...string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
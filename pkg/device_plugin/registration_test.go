@@ -0,0 +1,231 @@
+package device_plugin
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// countingBackend is a passthrough backend whose health check only counts how
+// many instances of it are running.
+type countingBackend struct {
+	pciBackend
+	running atomic.Int32
+}
+
+func (b *countingBackend) healthCheck(ctx context.Context, dp *GenericDevicePlugin) error {
+	b.running.Add(1)
+	defer b.running.Add(-1)
+	<-ctx.Done()
+	return nil
+}
+
+func newCountingPlugin(t *testing.T) (*GenericDevicePlugin, *countingBackend) {
+	t.Helper()
+	backend := &countingBackend{pciBackend: pciBackend{devicePath: iommuGroupBasePath}}
+	return newGenericDevicePlugin("1330", DeviceNamespace, backend), backend
+}
+
+// waitForHealthChecks waits until exactly n health checks of backend are running.
+func waitForHealthChecks(t *testing.T, backend *countingBackend, n int32) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for backend.running.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d health checks running, want %d", backend.running.Load(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForStreamEnd waits until the server ends the ListAndWatch stream.
+func waitForStreamEnd(t *testing.T, stream pluginapi.DevicePlugin_ListAndWatchClient) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		for {
+			if _, err := stream.Recv(); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("ListAndWatch stream was not ended")
+	}
+}
+
+func TestRegistrationRetriedUntilKubeletIsUp(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+	setDuration(t, &registrationBackoffInitial, 10*time.Millisecond)
+
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	time.Sleep(100 * time.Millisecond)
+	if dp.isRegistered() {
+		t.Fatal("registered without a kubelet")
+	}
+
+	kubelet := newFakeKubelet(t)
+	if req := kubelet.waitForRegistration(t); req.ResourceName != "xdxct.com/1330" {
+		t.Errorf("registered %s, want xdxct.com/1330", req.ResourceName)
+	}
+	waitForReady(t, dp)
+}
+
+func TestReregistrationWhenKubeletRestarts(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+
+	kubelet := newFakeKubelet(t)
+	dp := NewGenericaDevicePlugin("1330", iommuGroupBasePath)
+	startTestPlugin(t, dp)
+	kubelet.waitForRegistration(t)
+
+	// stopping the server removes kubelet.sock, a new kubelet creates it again
+	kubelet.server.Stop()
+	kubelet = newFakeKubelet(t)
+	if req := kubelet.waitForRegistration(t); req.ResourceName != "xdxct.com/1330" {
+		t.Errorf("registered %s, want xdxct.com/1330", req.ResourceName)
+	}
+}
+
+func TestRestartOnSocketRemoval(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+
+	kubelet := newFakeKubelet(t)
+	dp, backend := newCountingPlugin(t)
+	startTestPlugin(t, dp)
+	kubelet.waitForRegistration(t)
+
+	for i := 0; i < 5; i++ {
+		waitForHealthChecks(t, backend, 1)
+		stream := listAndWatch(t, dialDevicePlugin(t, dp))
+		recvDevices(t, stream)
+
+		// what kubelet does to every plugin socket when it restarts
+		if err := os.Remove(dp.sockPath); err != nil {
+			t.Fatal(err)
+		}
+		waitForStreamEnd(t, stream)
+		if req := kubelet.waitForRegistration(t); req.ResourceName != "xdxct.com/1330" {
+			t.Fatalf("registered %s, want xdxct.com/1330", req.ResourceName)
+		}
+		waitForReady(t, dp)
+	}
+	waitForHealthChecks(t, backend, 1)
+
+	if err := dp.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := backend.running.Load(); n != 0 {
+		t.Errorf("%d health checks still running after Stop", n)
+	}
+	if _, err := os.Stat(dp.sockPath); !os.IsNotExist(err) {
+		t.Errorf("socket left behind after Stop: %v", err)
+	}
+}
+
+func TestShutdownAfterRestart(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+
+	kubelet := newFakeKubelet(t)
+	dp, backend := newCountingPlugin(t)
+	shutdown := startTestPlugin(t, dp)
+	kubelet.waitForRegistration(t)
+
+	if err := os.Remove(dp.sockPath); err != nil {
+		t.Fatal(err)
+	}
+	kubelet.waitForRegistration(t)
+	waitForReady(t, dp)
+	stream := listAndWatch(t, dialDevicePlugin(t, dp))
+	recvDevices(t, stream)
+
+	// the restarted server still belongs to the context the plugin was started with
+	shutdown()
+	waitForStreamEnd(t, stream)
+	waitForHealthChecks(t, backend, 0)
+	if err := dp.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopDuringRestart(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+
+	kubelet := newFakeKubelet(t)
+	dp, backend := newCountingPlugin(t)
+	startTestPlugin(t, dp)
+	kubelet.waitForRegistration(t)
+
+	if err := os.Remove(dp.sockPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart racing with Stop must not bring the plugin back
+	time.Sleep(200 * time.Millisecond)
+	if n := backend.running.Load(); n != 0 {
+		t.Errorf("%d health checks running after Stop", n)
+	}
+	if _, err := os.Stat(dp.sockPath); !os.IsNotExist(err) {
+		t.Errorf("plugin serving again after Stop: %v", err)
+	}
+}
+
+// waitForFailure waits until dp reports a failure that makes /healthz fail.
+func waitForFailure(t *testing.T, dp *GenericDevicePlugin) error {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for dp.live() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s device plugin did not report a failure", dp.deviceName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return dp.live()
+}
+
+func TestRestartRetriedUntilListenSucceeds(t *testing.T) {
+	newTestHost(t)
+	createIommuDeviceMap()
+	setDuration(t, &registrationBackoffInitial, 50*time.Millisecond)
+
+	kubelet := newFakeKubelet(t)
+	dp, _ := newCountingPlugin(t)
+	startTestPlugin(t, dp)
+	kubelet.waitForRegistration(t)
+
+	// the socket goes away together with its directory, so listening on it fails
+	if err := os.RemoveAll(devicePluginPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForFailure(t, dp); !strings.Contains(err.Error(), "restart failed") {
+		t.Errorf("live = %v, want the failed restart", err)
+	}
+
+	if err := os.MkdirAll(devicePluginPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	kubelet = newFakeKubelet(t)
+	kubelet.waitForRegistration(t)
+	waitForReady(t, dp)
+	if err := dp.live(); err != nil {
+		t.Errorf("live = %v after the restart succeeded", err)
+	}
+	recvDevices(t, listAndWatch(t, dialDevicePlugin(t, dp)))
+}
@@ -0,0 +1,123 @@
+package device_plugin
+
+import (
+	"log"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// a ConfigMap update swaps a symlink and removes the old data directory, wait
+// for the whole update before reading the file again.
+const configSettleDelay = time.Second
+
+// watchConfig reloads the configuration file whenever it changes until stop is
+// closed. The directory is watched rather than the file, so that the file being
+// replaced (editors, ConfigMap updates) is noticed as well.
+func watchConfig(path string, stop <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Unable to create fsnotify watcher for %s, config changes require a restart: %v", path, err)
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		log.Printf("Unable to watch %s, config changes require a restart: %v", path, err)
+		return
+	}
+
+	settle := time.NewTimer(configSettleDelay)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			settle.Reset(configSettleDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Config watcher error: %v", err)
+		case <-settle.C:
+			reloadConfig(path)
+		}
+	}
+}
+
+// reloadConfig applies the configuration file at path to the running daemon.
+// An invalid file is logged and the configuration in effect is kept. Only the
+// device plugins whose resources are affected by the change are restarted.
+func reloadConfig(path string) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		log.Printf("Ignoring config change: %v", err)
+		return
+	}
+	discoveryLock.Lock()
+	defer discoveryLock.Unlock()
+	old := getConfig()
+	if reflect.DeepEqual(cfg, old) {
+		return
+	}
+
+	// the plugins are registered under the namespace and serve on sockets
+	// below the paths, neither can be changed underneath them. The HTTP
+	// server, the node labeler and the event recorder only start at startup.
+	if cfg.ResourceNamespace != old.ResourceNamespace {
+		log.Printf("Changing resourceNamespace from %s to %s requires a restart, keeping %s", old.ResourceNamespace, cfg.ResourceNamespace, old.ResourceNamespace)
+		cfg.ResourceNamespace = old.ResourceNamespace
+	}
+	if cfg.HTTPAddress != old.HTTPAddress {
+		log.Printf("Changing httpAddress requires a restart, keeping %s", old.HTTPAddress)
+		cfg.HTTPAddress = old.HTTPAddress
+	}
+	if cfg.NodeLabels != old.NodeLabels {
+		log.Printf("Changing nodeLabels requires a restart, keeping %t", old.NodeLabels)
+		cfg.NodeLabels = old.NodeLabels
+	}
+	if cfg.Events != old.Events {
+		log.Printf("Changing events requires a restart, keeping %t", old.Events)
+		cfg.Events = old.Events
+	}
+	if cfg.Paths != old.Paths {
+		log.Printf("Changing paths requires a restart, keeping %+v", old.Paths)
+		cfg.Paths = old.Paths
+	}
+
+	log.Printf("Reloading config %s", path)
+	swapConfig(cfg)
+
+	if !reflect.DeepEqual(cfg.MdevLayout, old.MdevLayout) {
+		if err := applyMdevLayout(cfg.MdevLayout); err != nil {
+			log.Printf("Failed to apply mdev layout: %v", err)
+		}
+	}
+
+	if !reflect.DeepEqual(cfg.Selectors, old.Selectors) || !reflect.DeepEqual(cfg.DeviceSets, old.DeviceSets) ||
+		cfg.Driver != old.Driver || !reflect.DeepEqual(cfg.ResourceNames, old.ResourceNames) {
+		iommus, devices, namespaces := discoverIommuDevices()
+		deviceMapLock.Lock()
+		iommuMap, deviceMap, pciNamespaceMap = iommus, devices, namespaces
+		deviceMapLock.Unlock()
+		reconcilePciDevicePlugins(devices)
+	}
+	if !reflect.DeepEqual(cfg.MdevLayout, old.MdevLayout) ||
+		!reflect.DeepEqual(cfg.MdevResourceNames, old.MdevResourceNames) {
+		vgpus, gpuVgpus := discoverVgpus()
+		deviceMapLock.Lock()
+		vGpuMap, gpuVgpuMap = vgpus, gpuVgpus
+		deviceMapLock.Unlock()
+		reconcileVgpuDevicePlugins(vgpus)
+	}
+}
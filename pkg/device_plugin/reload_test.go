@@ -0,0 +1,181 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+// newReloadHost adds a second model, 1340 in IOMMU group 11, to newTestHost,
+// loads the configuration from a file like the daemon does and starts the
+// passthrough plugins. It returns the path of the file.
+func newReloadHost(t *testing.T) (*fakeKubelet, string) {
+	s := newTestHost(t)
+	s.addPciDevice(pciDevice{addr: "0000:d8:00.0", vendor: "1eed", device: "1340", class: "030000", driver: "vfio-pci", group: "11"})
+	kubelet := newFakeKubelet(t)
+	useDaemonPlugins(t)
+
+	path := filepath.Join(s.root, "config", "config.yaml")
+	writeConfig(t, path, s.cfg)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetConfig(cfg)
+	refreshPciDevicePlugins()
+	for i := 0; i < 2; i++ {
+		kubelet.waitForRegistration(t)
+	}
+	return kubelet, path
+}
+
+func writeConfig(t *testing.T, path string, cfg *Config) {
+	t.Helper()
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recvUntil reads the stream until the device has the given health.
+func recvUntil(t *testing.T, stream pluginapi.DevicePlugin_ListAndWatchClient, id string, health string) {
+	t.Helper()
+	for i := 0; i < 5; i++ {
+		if recvDevices(t, stream)[id] == health {
+			return
+		}
+	}
+	t.Fatalf("device %s never became %s", id, health)
+}
+
+func TestWatchConfigRename(t *testing.T) {
+	kubelet, path := newReloadHost(t)
+	renamed, kept := daemonPlugin("1330"), daemonPlugin("1340")
+	stream := listAndWatch(t, dialDevicePlugin(t, kept))
+	recvDevices(t, stream)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchConfig(path, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// rewritten until the watcher, which may not be watching yet, applies it
+	cfg := *getConfig()
+	cfg.ResourceNames = map[string]string{"1330": "Pangu_A0"}
+	deadline := time.Now().Add(testTimeout)
+	for getConfig().ResourceNames["1330"] != "Pangu_A0" {
+		if time.Now().After(deadline) {
+			t.Fatal("config change was not applied")
+		}
+		writeConfig(t, path, &cfg)
+		time.Sleep(3 * configSettleDelay / 2)
+	}
+
+	if req := kubelet.waitForRegistration(t); req.ResourceName != "xdxct.com/Pangu_A0" {
+		t.Fatalf("registered %s, want xdxct.com/Pangu_A0", req.ResourceName)
+	}
+	if daemonPlugin("1330") != nil {
+		t.Error("plugin under the old name still running")
+	}
+	if _, err := os.Stat(renamed.sockPath); !os.IsNotExist(err) {
+		t.Errorf("socket of the renamed plugin left behind: %v", err)
+	}
+	if daemonPlugin("1340") != kept {
+		t.Fatal("plugin of the unchanged resource was replaced")
+	}
+	kept.reportHealth("11", pluginapi.Unhealthy, "test")
+	recvUntil(t, stream, "11", pluginapi.Unhealthy)
+}
+
+func TestReloadConfigIgnored(t *testing.T) {
+	_, path := newReloadHost(t)
+	old := getConfig()
+
+	if err := os.WriteFile(path, []byte("selectors: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(path)
+	if getConfig() != old {
+		t.Error("invalid config file replaced the config in effect")
+	}
+
+	cfg := *getConfig()
+	cfg.ResourceNamespace = "example.com"
+	cfg.Paths.CdiSpecs = "/elsewhere/cdi"
+	cfg.VgpuAllocationPolicy = allocationPolicySpread
+	writeConfig(t, path, &cfg)
+	reloadConfig(path)
+
+	got := getConfig()
+	if got.ResourceNamespace != old.ResourceNamespace || DeviceNamespace != old.ResourceNamespace {
+		t.Errorf("resourceNamespace changed to %s (%s)", got.ResourceNamespace, DeviceNamespace)
+	}
+	if got.Paths != old.Paths || cdiSpecPath != old.Paths.CdiSpecs {
+		t.Errorf("paths changed to %+v", got.Paths)
+	}
+	if got.VgpuAllocationPolicy != allocationPolicySpread {
+		t.Errorf("vgpuAllocationPolicy = %s, want the reloaded %s", got.VgpuAllocationPolicy, allocationPolicySpread)
+	}
+	if daemonPlugin("1330") == nil || daemonPlugin("1330").namespace != old.ResourceNamespace {
+		t.Error("plugin for 1330 moved to another namespace")
+	}
+}
+
+func TestReloadDuringRediscovery(t *testing.T) {
+	_, path := newReloadHost(t)
+	base := *getConfig()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			cfg := base
+			if i%2 == 0 {
+				cfg.ResourceNames = map[string]string{"1340": "Model_B"}
+			}
+			writeConfig(t, path, &cfg)
+			reloadConfig(path)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			refreshPciDevicePlugins()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+
+	// the last reload named 1340 Model_B
+	pciPluginsLock.Lock()
+	defer pciPluginsLock.Unlock()
+	var names []string
+	for name := range pciPlugins {
+		names = append(names, name)
+	}
+	if want := map[string]bool{"1330": true, "Model_B": true}; len(names) != 2 || !want[names[0]] || !want[names[1]] {
+		t.Errorf("plugins = %v, want %v", names, want)
+	}
+	if !reflect.DeepEqual(getConfig().ResourceNames, map[string]string{"1340": "Model_B"}) {
+		t.Errorf("resourceNames = %v", getConfig().ResourceNames)
+	}
+}
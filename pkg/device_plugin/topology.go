@@ -0,0 +1,108 @@
+package device_plugin
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+var pciAddrReg = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
+// deviceTopology is where a device sits in the host: its NUMA node and the
+// chain of PCI root bus and bridges (switch ports) above it.
+type deviceTopology struct {
+	numaNode int
+	// ancestry is ordered from the root bus (e.g. pci0000:3a) down to the
+	// closest bridge. Devices behind the same switch share a longer prefix.
+	ancestry []string
+	// parent is the GPU a vGPU was created on, empty for passthrough devices.
+	parent string
+}
+
+// readNumaNode returns the NUMA node of a PCI function, or -1 if the kernel
+// does not know it.
+func readNumaNode(addr string) int {
+	data, err := os.ReadFile(filepath.Join(basePciPath, addr, "numa_node"))
+	if err != nil {
+		return -1
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// numaTopologyInfo returns the NUMA nodes the given PCI functions are attached
+// to. Functions with an unknown node (-1) are ignored, and nil is returned when
+// no node is known at all, which kubelet treats as "no preference". An IOMMU
+// group spanning several nodes is reported with all of them.
+func numaTopologyInfo(addrs []string) *pluginapi.TopologyInfo {
+	seen := make(map[int]bool)
+	var nodes []int
+	for _, addr := range addrs {
+		node := readNumaNode(addr)
+		if node < 0 || seen[node] {
+			continue
+		}
+		seen[node] = true
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	sort.Ints(nodes)
+
+	topology := &pluginapi.TopologyInfo{}
+	for _, node := range nodes {
+		topology.Nodes = append(topology.Nodes, &pluginapi.NUMANode{ID: int64(node)})
+	}
+	return topology
+}
+
+// readPciAncestry resolves the sysfs device path of a PCI function, e.g.
+// /sys/devices/pci0000:3a/0000:3a:00.0/0000:3b:00.0, into its upstream chain.
+func readPciAncestry(addr string) []string {
+	path, err := filepath.EvalSymlinks(filepath.Join(basePciPath, addr))
+	if err != nil {
+		return nil
+	}
+	var ancestry []string
+	for _, part := range strings.Split(filepath.Dir(path), string(filepath.Separator)) {
+		if strings.HasPrefix(part, "pci") || pciAddrReg.MatchString(part) {
+			ancestry = append(ancestry, part)
+		}
+	}
+	return ancestry
+}
+
+func readPciTopology(addr string) deviceTopology {
+	return deviceTopology{
+		numaNode: readNumaNode(addr),
+		ancestry: readPciAncestry(addr),
+	}
+}
+
+// readVgpuTopology describes a vGPU by the topology of its parent GPU. The
+// parent itself is appended to the ancestry, so vGPUs on the same GPU are the
+// closest possible neighbours.
+func readVgpuTopology(parent string) deviceTopology {
+	topology := readPciTopology(parent)
+	topology.parent = parent
+	topology.ancestry = append(topology.ancestry, parent)
+	return topology
+}
+
+// commonAncestry returns how many upstream PCI components two devices share.
+func commonAncestry(a, b deviceTopology) int {
+	n := 0
+	for n < len(a.ancestry) && n < len(b.ancestry) && a.ancestry[n] == b.ancestry[n] {
+		n++
+	}
+	return n
+}
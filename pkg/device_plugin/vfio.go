@@ -0,0 +1,313 @@
+package device_plugin
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	pciBridgeClassPrefix = "0604"
+	vfioBindTimeout      = 5 * time.Second
+)
+
+// readPciIDs reads the sysfs ids of the PCI function. Functions without
+// subsystem ids leave them empty.
+func readPciIDs(addr string) (pciIDs, error) {
+	var ids pciIDs
+	for _, f := range []struct {
+		file string
+		id   *string
+	}{
+		{"vendor", &ids.vendor},
+		{"device", &ids.device},
+		{"class", &ids.class},
+	} {
+		id, err := readIDFromFile(basePciPath, addr, f.file)
+		if err != nil {
+			return ids, err
+		}
+		*f.id = id
+	}
+	ids.subsystemVendor, _ = readIDFromFile(basePciPath, addr, "subsystem_vendor")
+	ids.subsystemDevice, _ = readIDFromFile(basePciPath, addr, "subsystem_device")
+	return ids, nil
+}
+
+// selectPciDevice returns how the PCI function is bound and advertised if it
+// matches one of the configured device selectors. Both the vfio commands and
+// the device plugin discovery use it, so they always agree on which devices are
+// eligible.
+func selectPciDevice(addr string) (pciMatch, bool) {
+	ids, err := readPciIDs(addr)
+	if err != nil {
+		return pciMatch{}, false
+	}
+	return getConfig().matchPciDevice(ids)
+}
+
+func isSelectedPciDevice(addr string) bool {
+	_, ok := selectPciDevice(addr)
+	return ok
+}
+
+// selectedPciDevices returns the addresses of all eligible functions.
+func selectedPciDevices() ([]string, error) {
+	entries, err := os.ReadDir(basePciPath)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, entry := range entries {
+		if isSelectedPciDevice(entry.Name()) {
+			addrs = append(addrs, entry.Name())
+		}
+	}
+	return addrs, nil
+}
+
+// iommuGroupDevices returns every PCI function sharing the IOMMU group of addr.
+// vfio only hands out a group when all of its endpoints are bound to vfio-pci.
+func iommuGroupDevices(addr string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(basePciPath, addr, "iommu_group", "devices"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IOMMU group of %s: %v", addr, err)
+	}
+	var addrs []string
+	for _, entry := range entries {
+		addrs = append(addrs, entry.Name())
+	}
+	return addrs, nil
+}
+
+func currentPciDriver(addr string) string {
+	driver, err := os.Readlink(filepath.Join(basePciPath, addr, "driver"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(driver)
+}
+
+func isPciBridge(addr string) bool {
+	class, err := readIDFromFile(basePciPath, addr, "class")
+	return err == nil && strings.HasPrefix(class, pciBridgeClassPrefix)
+}
+
+// writeSysfs writes to a sysfs attribute. Tests replace it to apply the write
+// the way the kernel does.
+var writeSysfs = writeSysfsFunc
+
+func writeSysfsFunc(path string, value string) error {
+	return os.WriteFile(path, []byte(value), 0200)
+}
+
+func writePciFile(path string, value string) error {
+	if err := writeSysfs(path, value); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %v", value, path, err)
+	}
+	return nil
+}
+
+// vfioTarget is a PCI function to bind and the driver to bind it to.
+type vfioTarget struct {
+	addr   string
+	driver string
+}
+
+// vfioTargets resolves the functions to act on: the given device or every
+// eligible device, each expanded to its whole IOMMU group. With includeGroup,
+// the other members of a group are bound to the driver of the selected device.
+// Without it they are left alone, and a group with members no selector matches
+// bound to a host driver, which vfio would not hand out, is refused like the
+// doctor reports it: its devices are left out of the targets and the group is
+// described in refused.
+func vfioTargets(addr string, includeGroup bool) (targets []vfioTarget, refused []string, err error) {
+	var devices []string
+	if addr != "" {
+		if !isSelectedPciDevice(addr) {
+			return nil, nil, fmt.Errorf("%s does not match any device selector", addr)
+		}
+		devices = []string{addr}
+	} else {
+		devices, err = selectedPciDevices()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	passthrough := make(map[string]bool)
+	for _, driver := range getConfig().pciDrivers() {
+		passthrough[driver] = true
+	}
+	seen := make(map[string]bool)
+	for _, dev := range devices {
+		if seen[dev] {
+			continue
+		}
+		match, _ := selectPciDevice(dev)
+		group, err := iommuGroupDevices(dev)
+		if err != nil {
+			return nil, nil, err
+		}
+		var members []vfioTarget
+		var blockers []string
+		for _, member := range group {
+			seen[member] = true
+			if isPciBridge(member) {
+				continue
+			}
+			if m, ok := selectPciDevice(member); ok {
+				members = append(members, vfioTarget{addr: member, driver: m.driver})
+			} else if includeGroup {
+				members = append(members, vfioTarget{addr: member, driver: match.driver})
+			} else if driver := currentPciDriver(member); driver != "" && !passthrough[driver] {
+				blockers = append(blockers, fmt.Sprintf("%s (%s)", member, driver))
+			}
+		}
+		if len(blockers) > 0 {
+			groupID, _ := readLink(basePciPath, dev, "iommu_group")
+			refused = append(refused, fmt.Sprintf("IOMMU group %s of %s also holds %s, which no device selector matches",
+				groupID, dev, strings.Join(blockers, ", ")))
+			continue
+		}
+		targets = append(targets, members...)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].addr < targets[j].addr })
+	return targets, refused, nil
+}
+
+func ensureVfioDriver(driver string) error {
+	if _, err := os.Stat(pciDriverPath(driver)); err == nil {
+		return nil
+	}
+	if out, err := exec.Command("modprobe", driver).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s driver is not loaded and modprobe failed: %v: %s", driver, err, strings.TrimSpace(string(out)))
+	}
+	if _, err := os.Stat(pciDriverPath(driver)); err != nil {
+		return fmt.Errorf("%s driver is not available: %v", driver, err)
+	}
+	return nil
+}
+
+func bindToVfio(addr string, vfioDriver string) error {
+	driver := currentPciDriver(addr)
+	if driver == vfioDriver {
+		log.Printf("Device %s already bound to %s", addr, vfioDriver)
+		return nil
+	}
+
+	log.Printf("Binding device %s to %s", addr, vfioDriver)
+	if err := writePciFile(filepath.Join(basePciPath, addr, "driver_override"), vfioDriver); err != nil {
+		return err
+	}
+	if driver != "" {
+		log.Printf("Unbinding device %s from driver %s", addr, driver)
+		if err := writePciFile(filepath.Join(basePciPath, addr, "driver", "unbind"), addr); err != nil {
+			return err
+		}
+	}
+	if err := writePciFile(filepath.Join(filepath.Dir(basePciPath), "drivers_probe"), addr); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(vfioBindTimeout)
+	for currentPciDriver(addr) != vfioDriver {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device %s did not bind to %s", addr, vfioDriver)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+func unbindFromVfio(addr string, vfioDriver string) error {
+	driver := currentPciDriver(addr)
+	if driver != vfioDriver {
+		log.Printf("Device %s is not bound to %s, skipping", addr, vfioDriver)
+		return nil
+	}
+
+	log.Printf("Unbinding device %s from %s", addr, vfioDriver)
+	if err := writePciFile(filepath.Join(basePciPath, addr, "driver", "unbind"), addr); err != nil {
+		return err
+	}
+	if err := writePciFile(filepath.Join(basePciPath, addr, "driver_override"), "\n"); err != nil {
+		return err
+	}
+	// give the device back to its default host driver, if there is one
+	return writePciFile(filepath.Join(filepath.Dir(basePciPath), "drivers_probe"), addr)
+}
+
+// BindVfioDevices binds the given device, or all eligible ones if addr is
+// empty, to its passthrough driver. The other functions of its IOMMU group
+// are only bound along with it with includeGroup; otherwise a group with
+// functions no selector matches on a host driver is refused, after binding
+// every other group.
+func BindVfioDevices(addr string, includeGroup bool) error {
+	targets, refused, err := vfioTargets(addr, includeGroup)
+	if err != nil {
+		return err
+	}
+	ensured := make(map[string]bool)
+	for _, target := range targets {
+		if !ensured[target.driver] {
+			if err := ensureVfioDriver(target.driver); err != nil {
+				return err
+			}
+			ensured[target.driver] = true
+		}
+		if err := bindToVfio(target.addr, target.driver); err != nil {
+			return err
+		}
+	}
+	if len(refused) > 0 {
+		return fmt.Errorf("%s; use --include-group to bind them to the passthrough driver as well", strings.Join(refused, "; "))
+	}
+	return nil
+}
+
+// UnbindVfioDevices releases the given device, or all eligible ones if addr is
+// empty, together with the rest of its IOMMU group from its passthrough driver.
+func UnbindVfioDevices(addr string) error {
+	targets, _, err := vfioTargets(addr, true)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if err := unbindFromVfio(target.addr, target.driver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrintVfioStatus writes the driver binding of every eligible device.
+func PrintVfioStatus(w io.Writer) error {
+	addrs, err := selectedPciDevices()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tDEVICE\tCLASS\tDRIVER\tIOMMU GROUP")
+	for _, addr := range addrs {
+		deviceID, _ := readIDFromFile(basePciPath, addr, "device")
+		class, _ := readIDFromFile(basePciPath, addr, "class")
+		driver := currentPciDriver(addr)
+		if driver == "" {
+			driver = "-"
+		}
+		group, err := readLink(basePciPath, addr, "iommu_group")
+		if err != nil {
+			group = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", addr, deviceID, class, driver, group)
+	}
+	return tw.Flush()
+}
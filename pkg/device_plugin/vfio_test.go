@@ -0,0 +1,207 @@
+package device_plugin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newVfioHost adds to newAcceleratorHost a GPU on its host driver sharing IOMMU
+// group 50 with its audio function, a NIC and a bridge, and an unbound
+// accelerator of the abcd-vfio-pci selector sharing group 43 with a function
+// no selector matches.
+func newVfioHost(t *testing.T) *fakeSysfs {
+	s := newAcceleratorHost(t)
+	s.addPciDevice(pciDevice{addr: "0000:d7:00.0", vendor: "8086", device: "2030", class: "060400", driver: "pcieport", group: "50"})
+	s.addPciDevice(pciDevice{addr: "0000:d8:00.0", vendor: "1eed", device: "1330", class: "030000", driver: "xdxgpu", group: "50"})
+	s.addPciDevice(pciDevice{addr: "0000:d8:00.1", vendor: "1eed", device: "1331", class: "040300", driver: "snd_hda_intel", group: "50"})
+	s.addPciDevice(pciDevice{addr: "0000:d9:00.0", vendor: "8086", device: "1533", class: "020000", driver: "igb", group: "50"})
+	s.addPciDevice(pciDevice{addr: "0000:84:00.0", vendor: "abcd", device: "5678", class: "120000", group: "43"})
+	s.addPciDevice(pciDevice{addr: "0000:84:00.1", vendor: "abcd", device: "9999", class: "040300", group: "43"})
+	return s
+}
+
+func TestVfioTargets(t *testing.T) {
+	newVfioHost(t)
+	const nicRefused = "IOMMU group 50 of 0000:d8:00.0 also holds 0000:d9:00.0 (igb), which no device selector matches"
+
+	for _, tt := range []struct {
+		addr         string
+		includeGroup bool
+		want         []vfioTarget
+		wantRefused  []string
+	}{
+		// the NIC keeps the group from being bound
+		{addr: "0000:d8:00.0", wantRefused: []string{nicRefused}},
+		// the bridge stays, the NIC goes along with the GPU
+		{addr: "0000:d8:00.0", includeGroup: true, want: []vfioTarget{{"0000:d8:00.0", "vfio-pci"}, {"0000:d8:00.1", "vfio-pci"}, {"0000:d9:00.0", "vfio-pci"}}},
+		// the unbound unmatched member does not keep vfio from using the group
+		{addr: "0000:84:00.0", want: []vfioTarget{{"0000:84:00.0", "abcd-vfio-pci"}}},
+		// with the group it gets the driver of the selected device
+		{addr: "0000:84:00.0", includeGroup: true, want: []vfioTarget{{"0000:84:00.0", "abcd-vfio-pci"}, {"0000:84:00.1", "abcd-vfio-pci"}}},
+		{
+			want: []vfioTarget{
+				{"0000:3b:00.0", "vfio-pci"}, {"0000:3b:00.1", "vfio-pci"}, {"0000:3c:00.0", "vfio-pci"}, {"0000:3c:00.1", "vfio-pci"},
+				{"0000:5e:00.0", "vfio-pci"}, {"0000:81:00.0", "vfio-pci"}, {"0000:83:00.0", "abcd-vfio-pci"}, {"0000:84:00.0", "abcd-vfio-pci"},
+			},
+			wantRefused: []string{nicRefused},
+		},
+	} {
+		got, refused, err := vfioTargets(tt.addr, tt.includeGroup)
+		if err != nil {
+			t.Errorf("vfioTargets(%q, %v): %v", tt.addr, tt.includeGroup, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(refused, tt.wantRefused) {
+			t.Errorf("vfioTargets(%q, %v) = %v, %q, want %v, %q", tt.addr, tt.includeGroup, got, refused, tt.want, tt.wantRefused)
+		}
+	}
+
+	// the other accelerator has an unselected subsystem device
+	for _, addr := range []string{"0000:00:1f.0", "0000:82:00.0", "0000:84:00.1"} {
+		if _, _, err := vfioTargets(addr, true); err == nil || !strings.Contains(err.Error(), "does not match any device selector") {
+			t.Errorf("vfioTargets(%q) error = %v", addr, err)
+		}
+	}
+}
+
+func TestBindVfioDevices(t *testing.T) {
+	s := newVfioHost(t)
+
+	// --device-id of an unselected device binds nothing
+	if err := BindVfioDevices("0000:00:1f.0", false); err == nil {
+		t.Error("bound a device no selector matches")
+	}
+	if got := s.sysfsWrites(); len(got) != 0 {
+		t.Errorf("sysfs writes = %v", got)
+	}
+
+	// every group but the one with the NIC is bound
+	err := BindVfioDevices("", false)
+	if err == nil || !strings.Contains(err.Error(), "0000:d9:00.0 (igb)") || !strings.Contains(err.Error(), "--include-group") {
+		t.Errorf("err = %v, want the NIC refused", err)
+	}
+	for _, write := range s.sysfsWrites() {
+		if strings.Contains(write, "0000:d8:00") || strings.Contains(write, "0000:d9:00") {
+			t.Errorf("refused group written: %s", write)
+		}
+	}
+	for addr, driver := range map[string]string{
+		"0000:5e:00.0": "vfio-pci",
+		"0000:84:00.0": "abcd-vfio-pci",
+		"0000:84:00.1": "",
+		"0000:d8:00.0": "xdxgpu",
+		"0000:d9:00.0": "igb",
+	} {
+		if got := currentPciDriver(addr); got != driver {
+			t.Errorf("driver of %s = %q, want %q", addr, got, driver)
+		}
+	}
+
+	writes := len(s.sysfsWrites())
+	if err := BindVfioDevices("0000:d8:00.0", true); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"sys/bus/pci/devices/0000:d8:00.0/driver_override=vfio-pci",
+		"sys/bus/pci/devices/0000:d8:00.0/driver/unbind=0000:d8:00.0",
+		"sys/bus/pci/drivers_probe=0000:d8:00.0",
+		"sys/bus/pci/devices/0000:d8:00.1/driver_override=vfio-pci",
+		"sys/bus/pci/devices/0000:d8:00.1/driver/unbind=0000:d8:00.1",
+		"sys/bus/pci/drivers_probe=0000:d8:00.1",
+		"sys/bus/pci/devices/0000:d9:00.0/driver_override=vfio-pci",
+		"sys/bus/pci/devices/0000:d9:00.0/driver/unbind=0000:d9:00.0",
+		"sys/bus/pci/drivers_probe=0000:d9:00.0",
+	}
+	if got := s.sysfsWrites()[writes:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("sysfs writes = %v, want %v", got, want)
+	}
+
+	// unbound functions are only probed
+	writes = len(s.sysfsWrites())
+	if err := BindVfioDevices("0000:84:00.0", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.sysfsWrites()[writes:]; len(got) != 2 {
+		t.Errorf("sysfs writes = %v, want an override and a probe for 0000:84:00.1", got)
+	}
+	for addr, driver := range map[string]string{
+		"0000:d7:00.0": "pcieport",
+		"0000:d8:00.0": "vfio-pci",
+		"0000:d8:00.1": "vfio-pci",
+		"0000:d9:00.0": "vfio-pci",
+		"0000:84:00.1": "abcd-vfio-pci",
+	} {
+		if got := currentPciDriver(addr); got != driver {
+			t.Errorf("driver of %s = %q, want %s", addr, got, driver)
+		}
+	}
+
+	// binding again changes nothing
+	writes = len(s.sysfsWrites())
+	if err := BindVfioDevices("", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.sysfsWrites(); len(got) != writes {
+		t.Errorf("rebinding wrote %v", got[writes:])
+	}
+}
+
+func TestUnbindVfioDevices(t *testing.T) {
+	s := newVfioHost(t)
+	if err := BindVfioDevices("0000:d8:00.0", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnbindVfioDevices("0000:d8:00.0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"0000:d8:00.0", "0000:d8:00.1", "0000:d9:00.0"} {
+		if driver := currentPciDriver(addr); driver != "" {
+			t.Errorf("%s still bound to %s", addr, driver)
+		}
+		override, err := os.ReadFile(filepath.Join(s.devicePath(addr), "driver_override"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(override)) != "" {
+			t.Errorf("driver_override of %s = %q", addr, override)
+		}
+	}
+	if driver := currentPciDriver("0000:d7:00.0"); driver != "pcieport" {
+		t.Errorf("bridge bound to %q", driver)
+	}
+
+	// devices on another driver are left alone
+	writes := len(s.sysfsWrites())
+	if err := UnbindVfioDevices("0000:5e:00.0"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.sysfsWrites(); len(got) != writes {
+		t.Errorf("unbinding a device on its host driver wrote %v", got[writes:])
+	}
+}
+
+func TestPrintVfioStatus(t *testing.T) {
+	s := newTestHost(t)
+	if err := os.Remove(filepath.Join(s.devicePath("0000:3c:00.1"), "driver")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := PrintVfioStatus(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := "ADDRESS       DEVICE  CLASS   DRIVER    IOMMU GROUP\n" +
+		"0000:3b:00.0  1330    030000  vfio-pci  7\n" +
+		"0000:3b:00.1  1331    040300  vfio-pci  7\n" +
+		"0000:3c:00.0  1330    030000  vfio-pci  8\n" +
+		"0000:3c:00.1  1331    040300  -         8\n" +
+		"0000:5e:00.0  1330    030000  xdxgpu    20\n"
+	if out.String() != want {
+		t.Errorf("status =\n%s\nwant\n%s", out.String(), want)
+	}
+}